@@ -0,0 +1,127 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// AdminHandler returns the http.Handler of the admin API:
+// /search (if messages are stored), /tail (the live tail)
+// and /debug/vars (the metrics)
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	if s.Store != nil {
+		mux.Handle("/search", SearchHandler(s.Store))
+	}
+	mux.Handle("/tail", s.TailHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// ListenAdminHTTP listens on the given HTTP address (host:port) for the admin
+// API requests, requiring the "Authorization: Bearer token" header if token
+// is not empty, till ctx is done
+func ListenAdminHTTP(ctx context.Context, addr, token string, handler http.Handler) error {
+	if token != "" {
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")),
+				[]byte("Bearer "+token)) != 1 {
+				http.Error(w, "bad token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	log.Printf("start listening admin HTTP on %s", addr)
+	// the requests' context is ctx, so the tail streams end on shutdown
+	s := &http.Server{Addr: addr, Handler: handler,
+		BaseContext: func(net.Listener) context.Context { return ctx }}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Printf("error shutting down admin HTTP on %s: %s", addr, err)
+		}
+	}()
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		return fmt.Errorf("error listening admin HTTP on %s: %s", addr, err)
+	}
+	<-stopped
+	return nil
+}
+
+// AdminClient is a client of the admin API
+type AdminClient struct {
+	URL, Token string
+	client     *http.Client
+}
+
+// NewAdminClient returns a client of the admin API configured
+// in the transports config file
+func NewAdminClient(transports string) (*AdminClient, error) {
+	if err := TransportConfig.Parse(transports); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", transports, err)
+	}
+	if *adminHTTPPort <= 0 {
+		return nil, fmt.Errorf("no admin.http in %s", transports)
+	}
+	host := *adminAddress
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return &AdminClient{URL: "http://" + net.JoinHostPort(host, strconv.Itoa(*adminHTTPPort)),
+		Token: *adminToken, client: http.DefaultClient}, nil
+}
+
+// get GETs the path with the parameters
+func (c *AdminClient) get(path string, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(c.URL, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return resp, nil
+}
+
+// Search searches the stored messages, with the ParseSearchQuery parameters
+func (c *AdminClient) Search(params url.Values) (*SearchResult, error) {
+	resp, err := c.get("/search", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := new(SearchResult)
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, fmt.Errorf("error decoding search result: %s", err)
+	}
+	return res, nil
+}
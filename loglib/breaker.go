@@ -0,0 +1,198 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling a transport which is down
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type breakerState uint8
+
+const (
+	breakerClosed = breakerState(iota)
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops calling a transport after Threshold consecutive
+// failures, for Cooldown; then lets one probe through (half-open),
+// and closes on its success or opens again on its failure.
+type CircuitBreaker struct {
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+	// OnChange is called (in a new goroutine) when the breaker opens
+	// (down = true, with the last error) or closes again
+	OnChange func(name string, down bool, err error)
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// Do calls fun if the breaker allows it, and records its result
+func (cb *CircuitBreaker) Do(fun func() error) error {
+	if cb == nil || cb.Threshold <= 0 {
+		return fun()
+	}
+	cb.mu.Lock()
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.Cooldown {
+			cb.mu.Unlock()
+			return fmt.Errorf("%s: %s", cb.Name, ErrCircuitOpen)
+		}
+		cb.state = breakerHalfOpen
+	case breakerHalfOpen: // a probe is in flight
+		cb.mu.Unlock()
+		return fmt.Errorf("%s: %s", cb.Name, ErrCircuitOpen)
+	}
+	cb.mu.Unlock()
+
+	err := fun()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if err == nil {
+		if cb.state != breakerClosed {
+			log.Printf("circuit breaker %s closed", cb.Name)
+			cb.notify(false, nil)
+		}
+		cb.state, cb.failures = breakerClosed, 0
+		return nil
+	}
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.Threshold {
+		if cb.state == breakerClosed {
+			log.Printf("circuit breaker %s opened after %d failures: %s", cb.Name, cb.failures, err)
+			cb.notify(true, err)
+		}
+		cb.state, cb.openedAt = breakerOpen, time.Now()
+	}
+	return err
+}
+
+func (cb *CircuitBreaker) notify(down bool, err error) {
+	if cb.OnChange != nil {
+		go cb.OnChange(cb.Name, down, err)
+	}
+}
+
+type breakerSMSSender struct {
+	SMSSender
+	cb *CircuitBreaker
+}
+
+// Send sends the SMS through the circuit breaker
+func (bs breakerSMSSender) Send(to, message string) error {
+	return bs.cb.Do(func() error { return bs.SMSSender.Send(to, message) })
+}
+
+type breakerEmailSender struct {
+	EmailSender
+	cb *CircuitBreaker
+}
+
+// Send sends the email through the circuit breaker
+func (bs breakerEmailSender) Send(to []string, subject string, body []byte) error {
+	return bs.cb.Do(func() error { return bs.EmailSender.Send(to, subject, body) })
+}
+
+// breakerIssueTracker has a circuit breaker per issue tracker (per URL for Mantis)
+type breakerIssueTracker struct {
+	IssueTracker
+	name       string
+	newBreaker func(name string) *CircuitBreaker
+	mu         sync.Mutex
+	breakers   map[string]*CircuitBreaker
+}
+
+// NewIssue creates the issue through the circuit breaker of the tracker
+func (bs *breakerIssueTracker) NewIssue(issue Issue) (string, error) {
+	var key string
+	err := bs.breaker(issue).Do(func() error {
+		var err error
+		key, err = bs.IssueTracker.NewIssue(issue)
+		return err
+	})
+	return key, err
+}
+
+// IsOpen checks the issue through the circuit breaker of the tracker
+func (bs *breakerIssueTracker) IsOpen(issue Issue, key string) (bool, error) {
+	var open bool
+	err := bs.breaker(issue).Do(func() error {
+		var err error
+		open, err = bs.IssueTracker.IsOpen(issue, key)
+		return err
+	})
+	return open, err
+}
+
+// AddNote adds the note through the circuit breaker of the tracker
+func (bs *breakerIssueTracker) AddNote(issue Issue, key, note string) error {
+	return bs.breaker(issue).Do(func() error { return bs.IssueTracker.AddNote(issue, key, note) })
+}
+
+// breaker returns the circuit breaker of the issue's tracker
+func (bs *breakerIssueTracker) breaker(issue Issue) *CircuitBreaker {
+	name := bs.name
+	if issue.URL != "" {
+		if mantisURL, _, _, _, _, err := splitURL(issue.URL); err == nil {
+			name += " " + mantisURL
+		}
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	cb, ok := bs.breakers[name]
+	if !ok {
+		if bs.breakers == nil {
+			bs.breakers = make(map[string]*CircuitBreaker, 2)
+		}
+		cb = bs.newBreaker(name)
+		bs.breakers[name] = cb
+	}
+	return cb
+}
+
+// newBreaker returns a new CircuitBreaker with the configured limits,
+// sending the meta-alerts to the fallback destination
+func (s *Server) newBreaker(name string) *CircuitBreaker {
+	return &CircuitBreaker{Name: name, Threshold: s.breaker.threshold,
+		Cooldown: s.breaker.cooldown, OnChange: s.transportChanged}
+}
+
+// transportChanged sends a meta-alert about the transport's state change
+// to the fallback destination
+func (s *Server) transportChanged(name string, down bool, err error) {
+	if s.breaker.fallback == "" {
+		return
+	}
+	s.mu.RLock()
+	al, ok := s.Alerters[s.breaker.fallback]
+	s.mu.RUnlock()
+	if !ok {
+		log.Printf("unknown fallback destination %q", s.breaker.fallback)
+		return
+	}
+	host, _ := os.Hostname()
+	m := &Message{Host: host, Facility: "woodchuck", TimeUnix: time.Now().Unix(),
+		Level: int32(NOTICE), Short: fmt.Sprintf("destination %s is up again", name)}
+	if down {
+		m.Level = int32(ALERT)
+		m.Short = fmt.Sprintf("destination %s is down", name)
+		m.Full = err.Error()
+	}
+	s.deliver("circuit-breaker", Destination{Name: s.breaker.fallback, Alerter: al}, m, nil)
+}
@@ -0,0 +1,193 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// default maximal length (in runes) of the full message shown in the chat
+const defaultChatFullMax = 1000
+
+// levelColors are the attachment colors of the levels
+var levelColors = [8]string{"#7b0000", "#a30200", "#d50200", "#e8412c",
+	"#f2a900", "#2eb886", "#439fe0", "#9e9e9e"}
+
+// chatAlert posts Slack-compatible attachments to Slack or Mattermost
+// incoming webhooks
+type chatAlert struct {
+	URL      string
+	Channel  string
+	Username string
+	Icon     string
+	// Link is the base URL of the search API, for linking the stored message.
+	// As the admin API listens on loopback and needs the admin token,
+	// it must be the URL of an authenticating reverse proxy of it.
+	Link string
+	// FullMax is the maximal length of the full message shown
+	FullMax int
+	// Escape tells whether &, < and > must be escaped (Slack)
+	Escape bool
+}
+
+type chatField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type chatAttachment struct {
+	Fallback   string      `json:"fallback"`
+	Color      string      `json:"color"`
+	Title      string      `json:"title"`
+	TitleLink  string      `json:"title_link,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	Fields     []chatField `json:"fields"`
+	Footer     string      `json:"footer,omitempty"`
+	Timestamp  int64       `json:"ts,omitempty"`
+	MarkdownIn []string    `json:"mrkdwn_in,omitempty"`
+}
+
+type chatPayload struct {
+	Channel     string           `json:"channel,omitempty"`
+	Username    string           `json:"username,omitempty"`
+	IconEmoji   string           `json:"icon_emoji,omitempty"`
+	IconURL     string           `json:"icon_url,omitempty"`
+	Attachments []chatAttachment `json:"attachments"`
+}
+
+// Send sends the message to the chat
+func (a chatAlert) Send(m *Message, s SenderProvider) error {
+	return a.SendRule("", m, s)
+}
+
+// SendRule posts the message as an attachment, retrieving the WebhookSender
+// from the SenderProvider
+func (a chatAlert) SendRule(rule string, m *Message, s SenderProvider) error {
+	sender := s.GetWebhookSender(a.URL + "#" + m.String())
+	if sender == nil {
+		return nil
+	}
+	body, err := json.Marshal(a.payload(rule, m))
+	if err != nil {
+		return err
+	}
+	header := make(http.Header, 2)
+	header.Set("Content-Type", "application/json")
+	header.Set("User-Agent", "woodchuck")
+	return sender.Send("POST", a.URL, header, body)
+}
+
+// payload returns the attachment payload of the message
+func (a chatAlert) payload(rule string, m *Message) chatPayload {
+	p := chatPayload{Channel: a.Channel, Username: a.Username}
+	if strings.HasPrefix(a.Icon, ":") {
+		p.IconEmoji = a.Icon
+	} else {
+		p.IconURL = a.Icon
+	}
+	color := levelColors[len(levelColors)-1]
+	if m.Level >= 0 && int(m.Level) < len(levelColors) {
+		color = levelColors[m.Level]
+	}
+	att := chatAttachment{Fallback: a.escape(m.String()), Color: color,
+		Title:     a.escape(fmt.Sprintf("%s %s", levelName(m.Level), m.Short)),
+		TitleLink: a.link(m), Timestamp: m.TimeUnix,
+		Fields: []chatField{
+			{Title: "Host", Value: a.escape(m.Host), Short: true},
+			{Title: "Facility", Value: a.escape(m.Facility), Short: true},
+		},
+		MarkdownIn: []string{"text"}}
+	if m.File != "" {
+		att.Fields = append(att.Fields, chatField{Title: "Location",
+			Value: a.escape(fmt.Sprintf("%s:%d", m.File, m.Line)), Short: true})
+	}
+	if rule != "" {
+		att.Footer = "woodchuck " + a.escape(rule)
+	}
+	if full := strings.TrimSpace(m.Full); full != "" && full != m.Short {
+		if r := []rune(full); a.FullMax > 0 && len(r) > a.FullMax {
+			full = string(r[:a.FullMax]) + "…"
+		}
+		// a ``` would close the code block
+		full = strings.Replace(full, "```", "`\u200b``", -1)
+		att.Text = "```\n" + a.escape(full) + "\n```"
+	}
+	p.Attachments = []chatAttachment{att}
+	return p
+}
+
+// link returns the /search URL of the stored message (JSON, through the
+// proxy of the admin API), or "" if no Link is set
+func (a chatAlert) link(m *Message) string {
+	if a.Link == "" {
+		return ""
+	}
+	t := time.Unix(m.TimeUnix, 0).UTC()
+	params := url.Values{"from": {t.Format(time.RFC3339)},
+		"to":   {t.Add(time.Second).Format(time.RFC3339)},
+		"host": {m.Host}, "facility": {m.Facility}}
+	return strings.TrimRight(a.Link, "/") + "/search?" + params.Encode()
+}
+
+// escape escapes the control characters of Slack's message formatting
+func (a chatAlert) escape(s string) string {
+	if !a.Escape {
+		return s
+	}
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// buildChat builds the chat alerter of the destination from the
+// [destinations.NAME.slack] or [destinations.NAME.mattermost] table,
+// adding the errors to errs
+func buildChat(name, typ string, tree ConfigTree, errs *ConfigErrors) (chatAlert, bool) {
+	a := chatAlert{FullMax: defaultChatFullMax, Escape: typ == "slack", Username: "woodchuck"}
+	n := len(*errs)
+	str := func(k string) string {
+		s, ok := tree.Get(k).(string)
+		if !ok {
+			errs.Add(tree, k, "destination %s: %s %s must be a string", name, typ, k)
+		}
+		return s
+	}
+	for _, k := range tree.Keys() {
+		switch k {
+		case "url":
+			a.URL = str(k)
+		case "channel":
+			a.Channel = str(k)
+		case "username":
+			a.Username = str(k)
+		case "icon":
+			a.Icon = str(k)
+		case "link":
+			if a.Link = str(k); a.Link != "" {
+				if u, err := url.Parse(a.Link); err != nil || u.Host == "" {
+					errs.Add(tree, k, "destination %s: bad %s link %q", name, typ, a.Link)
+				}
+			}
+		case "full_max":
+			v, ok := tree.Get(k).(int64)
+			if !ok || v < 0 {
+				errs.Add(tree, k, "destination %s: %s full_max must be a non-negative integer", name, typ)
+				continue
+			}
+			a.FullMax = int(v)
+		default:
+			errs.Add(tree, k, "destination %s: unsupported %s key %q", name, typ, k)
+		}
+	}
+	if u, err := url.Parse(a.URL); a.URL == "" || err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.Add(tree, "url", "destination %s: %s needs an http(s) url, got %q", name, typ, a.URL)
+	}
+	return a, len(*errs) == n
+}
@@ -6,19 +6,39 @@
 package loglib
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"github.com/pelletier/go-toml"
 	"github.com/stvp/go-toml-config"
 	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	//TransportConfig is the configset for transportation settings
-	TransportConfig = config.NewConfigSet("transportation settings", config.ExitOnError)
+	TransportConfig = config.NewConfigSet("transportation settings", config.ContinueOnError)
 	from            = TransportConfig.String("from", "woodchuck")
 	gelfUdpPort     = TransportConfig.Int("gelf.udp", 12201)
 	gelfTcpPort     = TransportConfig.Int("gelf.tcp", 0)
+	gelfTcpFraming  = TransportConfig.String("gelf.tcp_framing", "null")
+	gelfTcpMaxSize  = TransportConfig.Int("gelf.tcp_maxsize", 1<<20)
+	gelfTcpIdle     = TransportConfig.Int("gelf.tcp_idle", 300)
 	gelfHTTPPort    = TransportConfig.Int("gelf.http", 0)
+	gelfHTTPMaxSize = TransportConfig.Int("gelf.http_maxsize", 1<<20)
+	gelfTLSCert     = TransportConfig.String("gelf.tls_cert", "")
+	gelfTLSKey      = TransportConfig.String("gelf.tls_key", "")
+	gelfTLSClientCA = TransportConfig.String("gelf.tls_client_ca", "")
+	gelfTLSRequire  = TransportConfig.Bool("gelf.tls_require_client_cert", false)
+	syslogUdpPort   = TransportConfig.Int("syslog.udp", 0)
+	syslogTcpPort   = TransportConfig.Int("syslog.tcp", 0)
+	syslogTcpIdle   = TransportConfig.Int("syslog.tcp_idle", 300)
 
 	twilioSid   = TransportConfig.String("twilio.sid", "")
 	twilioToken = TransportConfig.String("twilio.token", "")
@@ -28,11 +48,92 @@ var (
 	smtpAuth     = TransportConfig.String("smtp.auth", "")
 	smtpRate     = TransportConfig.Int("smtp.rate", 600)
 
-	mantisXmlrpc = TransportConfig.String("mantis.xmlrpc", "xmlrpc_vv.php")
-	mantisRate   = TransportConfig.Int("mantis.rate", 3600)
+	mantisXmlrpc   = TransportConfig.String("mantis.xmlrpc", "xmlrpc_vv.php")
+	mantisRate     = TransportConfig.Int("mantis.rate", 3600)
+	mantisUsername = TransportConfig.String("mantis.username", "")
+	mantisPassword = TransportConfig.String("mantis.password", "")
 
-	esURL = TransportConfig.String("elasticsearch.url", "http://localhost:9200")
-	esTTL = TransportConfig.Int("elasticsearch.ttl", 90)
+	jiraURL      = TransportConfig.String("jira.url", "")
+	jiraUsername = TransportConfig.String("jira.username", "")
+	jiraToken    = TransportConfig.String("jira.token", "")
+	jiraRate     = TransportConfig.Int("jira.rate", 3600)
+
+	githubURL   = TransportConfig.String("github.url", "https://api.github.com")
+	githubToken = TransportConfig.String("github.token", "")
+	githubRate  = TransportConfig.Int("github.rate", 3600)
+
+	giteaURL   = TransportConfig.String("gitea.url", "")
+	giteaToken = TransportConfig.String("gitea.token", "")
+	giteaRate  = TransportConfig.Int("gitea.rate", 3600)
+
+	issueTimeout = TransportConfig.Int("issue.timeout", 30)
+	// issueIndex is the file of the fingerprint → issue map, for adding
+	// notes to the open issues instead of creating new ones ("" disables)
+	issueIndex = TransportConfig.String("issue.index", "issues.json")
+	// issueIndexMaxAge is the time after the last occurrence of a
+	// fingerprint, when it is forgotten (and its next occurrence gets a new issue)
+	issueIndexMaxAge = TransportConfig.Int("issue.index_max_age", 90*86400)
+
+	// pagerdutyIndex is the file of the open incidents (of the pagerduty
+	// and opsgenie destinations), for resolving them after restart, too
+	// ("" keeps them in memory only)
+	pagerdutyIndex = TransportConfig.String("pagerduty.index", "incidents.json")
+
+	webhookRate    = TransportConfig.Int("webhook.rate", 60)
+	webhookTimeout = TransportConfig.Int("webhook.timeout", 10)
+
+	esURL           = TransportConfig.String("elasticsearch.url", "http://localhost:9200")
+	esIndex         = TransportConfig.String("elasticsearch.index", "woodchuck")
+	esBulkSize      = TransportConfig.Int("elasticsearch.bulk_size", 1000)
+	esBulkBytes     = TransportConfig.Int("elasticsearch.bulk_bytes", 5<<20)
+	esFlushInterval = TransportConfig.Int("elasticsearch.flush_interval", 5)
+	esMaxRetries    = TransportConfig.Int("elasticsearch.max_retries", 5)
+	// esTTL is the retention of the daily indices in days, esFacilityTTL
+	// lists the facilities with their own retention as facility:days,...
+	esTTL               = TransportConfig.Int("elasticsearch.ttl", 90)
+	esFacilityTTL       = TransportConfig.String("elasticsearch.facility_ttl", "")
+	esRetentionInterval = TransportConfig.Int("elasticsearch.retention_interval", 3600)
+	esRetentionDryRun   = TransportConfig.Bool("elasticsearch.retention_dry_run", false)
+
+	// storeType is elasticsearch, file or none
+	storeType              = TransportConfig.String("store.type", "elasticsearch")
+	storeDir               = TransportConfig.String("store.dir", "store")
+	storeSegmentSize       = TransportConfig.Int("store.segment_size", 64<<20)
+	storeTTL               = TransportConfig.Int("store.ttl", 90)
+	storeMaxSize           = TransportConfig.Int("store.max_size", 0)
+	storeBatchSize         = TransportConfig.Int("store.batch_size", 1000)
+	storeFlushInterval     = TransportConfig.Int("store.flush_interval", 5)
+	storeRetentionInterval = TransportConfig.Int("store.retention_interval", 3600)
+	storeRetentionDryRun   = TransportConfig.Bool("store.retention_dry_run", false)
+
+	reloadWatch = TransportConfig.Int("reload.watch", 0)
+
+	adminHTTPPort = TransportConfig.Int("admin.http", 0)
+	// adminAddress is the address the admin API listens on:
+	// any but a loopback address needs an admin.token
+	adminAddress = TransportConfig.String("admin.address", "127.0.0.1")
+	adminToken   = TransportConfig.String("admin.token", "")
+
+	queueDir           = TransportConfig.String("queue.dir", "")
+	queueSegmentSize   = TransportConfig.Int("queue.segment_size", 16<<20)
+	queueMaxSize       = TransportConfig.Int("queue.max_size", 1<<30)
+	queueMaxAge        = TransportConfig.Int("queue.max_age", 7*86400)
+	queueFsync         = TransportConfig.String("queue.fsync", FsyncInterval)
+	queueFsyncInterval = TransportConfig.Int("queue.fsync_interval", 1)
+
+	deliveryWorkers     = TransportConfig.Int("delivery.workers", 2)
+	deliveryQueueLen    = TransportConfig.Int("delivery.queue", 1000)
+	deliveryMaxAttempts = TransportConfig.Int("delivery.max_attempts", 5)
+	deliveryMaxAge      = TransportConfig.Int("delivery.max_age", 3600)
+	deliveryBackoffMin  = TransportConfig.Int("delivery.backoff_min", 5)
+	deliveryBackoffMax  = TransportConfig.Int("delivery.backoff_max", 600)
+	deadLetterDir       = TransportConfig.String("delivery.deadletter_dir", "deadletter")
+
+	breakerThreshold = TransportConfig.Int("breaker.threshold", 5)
+	breakerCooldown  = TransportConfig.Int("breaker.cooldown", 60)
+	breakerFallback  = TransportConfig.String("breaker.fallback", "")
+
+	shutdownTimeout = TransportConfig.Int("shutdown.timeout", 30)
 )
 
 // SMSSender is the SMS sender interface (just to and from)
@@ -45,36 +146,75 @@ type EmailSender interface {
 	Send(to []string, subject string, body []byte) error
 }
 
-// MantisSender is an interface for an issue tracker injector
-type MantisSender interface {
-	Send(uri, subject, body string) (int, error)
+// WebhookSender is the HTTP request sender interface
+type WebhookSender interface {
+	Send(method, url string, header http.Header, body []byte) error
 }
 
 // SenderProvider is an interface for returning the specific senders
 type SenderProvider interface {
 	GetSMSSender(string) SMSSender
 	GetEmailSender(string) EmailSender
-	GetMantisSender(string) MantisSender
+	GetIssueTracker(kind, txt string) IssueTracker
+	GetWebhookSender(string) WebhookSender
 }
 
 // Server is the server context
 type Server struct {
 	in, store chan *Message
+	queue     *DiskQueue
 	sms       SMSSender
 	email     EmailSender
-	mantis    MantisSender
+	trackers  map[string]IssueTracker
+	webhook   WebhookSender
+	tlsConfig *tls.Config
+	incidents *IncidentIndex
 	Rules     []Rule
 	Matchers  map[string]Matcher
 	Alerters  map[string]Alerter
-	routines  []func()
+	routines  []func(context.Context) error
 	rates     struct {
-		limiter            RateLimiter
-		sms, email, mantis time.Duration
+		limiter             RateLimiter
+		sms, email, webhook time.Duration
+		issue               map[string]time.Duration
+	}
+
+	// mu guards Rules, Matchers and Alerters, which are swapped on Reload
+	mu                          sync.RWMutex
+	transportsFile, filtersFile string
+	// transports are the transport settings read at start
+	transports map[string]string
+
+	deliveryConfig DeliveryConfig
+	deliverersMu   sync.Mutex
+	deliverers     map[string]*Deliverer
+	// DeadLetters stores the given up deliveries, if not nil
+	DeadLetters *DeadLetterStore
+	// Store is the message store, if configured
+	Store Store
+	// tail distributes the processed messages to the live tail subscribers
+	tail    tailHub
+	breaker struct {
+		threshold int
+		cooldown  time.Duration
+		// fallback is the destination of the transport down/up meta-alerts
+		fallback string
 	}
+
+	// storer stores the messages from store, till it is closed
+	storer          func()
+	shutdownTimeout time.Duration
+	// cancel stops the routines
+	cancel       context.CancelFunc
+	routinesWg   sync.WaitGroup
+	served       chan struct{}
+	stored       chan struct{}
+	acked        chan struct{}
+	shutdownOnce sync.Once
 }
 
 // GetSMSSender returns the SMSSender, implementing rate limiting
-func (s Server) GetSMSSender(txt string) SMSSender {
+func (s *Server) GetSMSSender(txt string) SMSSender {
 	if s.rates.limiter != nil && s.rates.sms > 0 && !s.rates.limiter.Put(s.rates.sms, txt) {
 		return nil
 	}
@@ -82,85 +222,492 @@ func (s Server) GetSMSSender(txt string) SMSSender {
 }
 
 // GetEmailSender returns the EmailSender, if not above rate limit
-func (s Server) GetEmailSender(txt string) EmailSender {
+func (s *Server) GetEmailSender(txt string) EmailSender {
 	if s.rates.limiter != nil && s.rates.email > 0 && !s.rates.limiter.Put(s.rates.email, txt) {
 		return nil
 	}
 	return s.email
 }
 
-// GetMantisSender returns the MantisSender, if not above rate limit
-func (s Server) GetMantisSender(txt string) MantisSender {
-	if s.rates.limiter != nil && s.rates.mantis > 0 && !s.rates.limiter.Put(s.rates.mantis, txt) {
+// GetIssueTracker returns the IssueTracker of the kind, if not above rate limit
+func (s *Server) GetIssueTracker(kind, txt string) IssueTracker {
+	if rate := s.rates.issue[kind]; s.rates.limiter != nil && rate > 0 && !s.rates.limiter.Put(rate, txt) {
 		return nil
 	}
-	return s.mantis
+	return s.trackers[kind]
 }
 
-// LoadConfig loads the config read from the transports and filters TOML files
-func LoadConfig(transports, filters string) (s *Server, err error) {
-	log.Printf("loading transports config file %s", filters)
-	if err = TransportConfig.Parse(transports); err != nil {
-		return
+// countIssue counts the rate limited occurrence of the fingerprint's
+// issue, so the note of the next reported occurrence includes it
+func (s *Server) countIssue(kind, fingerprint string) {
+	if dt, ok := s.trackers[kind].(*dedupIssueTracker); ok && fingerprint != "" {
+		dt.count(fingerprint)
 	}
-	s = &Server{routines: make([]func(), 0, 4), in: make(chan *Message)}
-	s.rates.limiter = NewRateLimiter(time.Hour)
-	if *esURL != "" {
-		log.Printf("starting storage goroutine for %s", *esURL)
-		s.store = make(chan *Message)
-		s.routines = append(s.routines, func() {
-			storeEs(*esURL, *esTTL, s.store)
+}
+
+// GetWebhookSender returns the WebhookSender, if not above rate limit
+func (s *Server) GetWebhookSender(txt string) WebhookSender {
+	if s.rates.limiter != nil && s.rates.webhook > 0 && !s.rates.limiter.Put(s.rates.webhook, txt) {
+		return nil
+	}
+	return s.webhook
+}
+
+// openStore opens the configured message store (nil for none), returning
+// it with the interval and the dry-run setting of its retention job
+func openStore() (Store, time.Duration, bool, error) {
+	switch *storeType {
+	case "elasticsearch":
+		if *esURL == "" {
+			return nil, 0, false, nil
+		}
+		es, err := NewElasticSearch(*esURL, *esIndex)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if es.Retention, err = ParseRetention(*esTTL, *esFacilityTTL); err != nil {
+			return nil, 0, false, fmt.Errorf("elasticsearch.facility_ttl: %s", err)
+		}
+		es.BulkConfig = BulkConfig{
+			Size:          *esBulkSize,
+			Bytes:         *esBulkBytes,
+			FlushInterval: time.Duration(*esFlushInterval) * time.Second,
+			MaxRetries:    *esMaxRetries,
+		}
+		return es, time.Duration(*esRetentionInterval) * time.Second, *esRetentionDryRun, nil
+	case "file":
+		fs, err := OpenFileStore(*storeDir, FileStoreConfig{
+			SegmentSize:   int64(*storeSegmentSize),
+			MaxAge:        *storeTTL,
+			MaxSize:       int64(*storeMaxSize),
+			BatchSize:     *storeBatchSize,
+			FlushInterval: time.Duration(*storeFlushInterval) * time.Second,
 		})
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("error opening file store %s: %s", *storeDir, err)
+		}
+		return fs, time.Duration(*storeRetentionInterval) * time.Second, *storeRetentionDryRun, nil
+	case "", "none":
+		return nil, 0, false, nil
+	}
+	return nil, 0, false, fmt.Errorf("unknown store.type %q", *storeType)
+}
+
+// checkStore checks the store settings, without opening the store
+func checkStore() error {
+	switch *storeType {
+	case "elasticsearch":
+		if _, err := ParseRetention(*esTTL, *esFacilityTTL); err != nil {
+			return fmt.Errorf("elasticsearch.facility_ttl: %s", err)
+		}
+	case "file", "", "none":
+	default:
+		return fmt.Errorf("unknown store.type %q", *storeType)
 	}
+	return nil
+}
+
+// checkAdmin refuses to expose the admin API without a token
+func checkAdmin() error {
+	if *adminHTTPPort <= 0 || *adminToken != "" || isLoopback(*adminAddress) {
+		return nil
+	}
+	return fmt.Errorf("admin.address %q is not a loopback address, so admin.token is needed", *adminAddress)
+}
+
+// isLoopback returns whether the host is a loopback address
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// LoadConfig loads the config read from the transports and filters TOML files,
+// and opens the resources (store, issue index, dead letters, queue) of the server
+func LoadConfig(transports, filters string) (*Server, error) {
+	s, err := ParseConfig(transports, filters)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseConfig parses and checks the transports and filters TOML files, and
+// builds the senders, matchers, alerters and rules of the server,
+// without opening any file or starting anything
+func ParseConfig(transports, filters string) (s *Server, err error) {
+	log.Printf("loading transports config file %s", transports)
+	if err = TransportConfig.Parse(transports); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", transports, err)
+	}
+	s = &Server{routines: make([]func(context.Context) error, 0, 4), in: make(chan *Message),
+		transportsFile: transports, filtersFile: filters,
+		shutdownTimeout: time.Duration(*shutdownTimeout) * time.Second}
+	if s.transports, err = readTransports(transports); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", transports, err)
+	}
+	s.deliveryConfig = DeliveryConfig{
+		Workers:     *deliveryWorkers,
+		QueueLen:    *deliveryQueueLen,
+		MaxAttempts: *deliveryMaxAttempts,
+		MaxAge:      time.Duration(*deliveryMaxAge) * time.Second,
+		BackoffMin:  time.Duration(*deliveryBackoffMin) * time.Second,
+		BackoffMax:  time.Duration(*deliveryBackoffMax) * time.Second,
+	}
+	if err = checkStore(); err != nil {
+		return nil, fmt.Errorf("%s: %s", transports, err)
+	}
+	if err = checkAdmin(); err != nil {
+		return nil, fmt.Errorf("%s: %s", transports, err)
+	}
+	s.breaker.threshold = *breakerThreshold
+	s.breaker.cooldown = time.Duration(*breakerCooldown) * time.Second
+	s.breaker.fallback = *breakerFallback
 	if *twilioSid != "" {
-		s.sms = NewTwilio("+1 858-500-3858", *twilioSid, *twilioToken)
+		s.sms = breakerSMSSender{NewTwilio("+1 858-500-3858", *twilioSid, *twilioToken),
+			s.newBreaker("sms")}
 		s.rates.sms = time.Duration(*twilioRate) * time.Second
 	}
 	if *smtpHostport != "" {
-		s.email = NewEmailSender(*from, *smtpHostport, *smtpAuth)
+		s.email = breakerEmailSender{NewEmailSender(*from, *smtpHostport, *smtpAuth),
+			s.newBreaker("email")}
 		s.rates.email = time.Duration(*smtpRate) * time.Second
 	}
-	s.mantis = NewMantisSender()
-	s.rates.mantis = time.Duration(*mantisRate) * time.Second
+	s.trackers = make(map[string]IssueTracker, 4)
+	s.rates.issue = make(map[string]time.Duration, 4)
+	addTracker := func(kind string, tracker IssueTracker, rate int) {
+		s.trackers[kind] = &breakerIssueTracker{IssueTracker: tracker, name: kind,
+			newBreaker: s.newBreaker}
+		s.rates.issue[kind] = time.Duration(rate) * time.Second
+	}
+	timeout := time.Duration(*issueTimeout) * time.Second
+	addTracker("mantis", NewMantisTracker(*mantisUsername, *mantisPassword, timeout), *mantisRate)
+	if *jiraURL != "" {
+		addTracker("jira", NewJiraTracker(*jiraURL, *jiraUsername, *jiraToken, timeout), *jiraRate)
+	}
+	if *githubToken != "" {
+		addTracker("github", NewGithubTracker(*githubURL, *githubToken, timeout), *githubRate)
+	}
+	if *giteaURL != "" {
+		addTracker("gitea", NewGiteaTracker(*giteaURL, *giteaToken, timeout), *giteaRate)
+	}
+	s.webhook = &breakerWebhookSender{
+		WebhookSender: NewWebhookSender(time.Duration(*webhookTimeout) * time.Second),
+		newBreaker:    s.newBreaker}
+	s.rates.webhook = time.Duration(*webhookRate) * time.Second
+	if *gelfTLSCert != "" {
+		if s.tlsConfig, err = NewTLSConfig(*gelfTLSCert, *gelfTLSKey,
+			*gelfTLSClientCA, *gelfTLSRequire); err != nil {
+			return nil, fmt.Errorf("%s: %s", transports, err)
+		}
+	}
+	switch *gelfTcpFraming {
+	case "null", "newline", "oneshot":
+	default:
+		return nil, fmt.Errorf("%s: unknown gelf.tcp_framing %q", transports, *gelfTcpFraming)
+	}
+
+	if s.Matchers, s.Alerters, s.Rules, err = LoadFilters(filters); err != nil {
+		return nil, err
+	}
+	if err = s.checkTransports(s.Alerters); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenStore opens the configured message store as s.Store (nil for none)
+func (s *Server) OpenStore() (err error) {
+	s.Store, _, _, err = openStore()
+	return err
+}
+
+// OpenDeadLetters opens the configured dead letter store as s.DeadLetters
+// (nil if delivery.deadletter_dir is empty)
+func (s *Server) OpenDeadLetters() (err error) {
+	if *deadLetterDir == "" {
+		return nil
+	}
+	if s.DeadLetters, err = OpenDeadLetterStore(*deadLetterDir); err != nil {
+		return fmt.Errorf("error opening dead letter store %s: %s", *deadLetterDir, err)
+	}
+	return nil
+}
+
+// open opens the store, the issue index, the dead letter store and the queue,
+// and registers the routines of the server
+func (s *Server) open() error {
+	s.rates.limiter = NewRateLimiter(time.Hour)
+	store, retention, dryRun, err := openStore()
+	if err != nil {
+		return fmt.Errorf("%s: %s", s.transportsFile, err)
+	}
+	if store != nil {
+		s.Store = store
+		if retention > 0 {
+			s.routines = append(s.routines, func(ctx context.Context) error {
+				retain(ctx, store, retention, dryRun)
+				return nil
+			})
+		}
+		log.Printf("starting storage goroutine for %s store", *storeType)
+		// buffered, so the processing does not wait for each message stored
+		n := *storeBatchSize
+		if n < 0 {
+			n = 0
+		}
+		s.store = make(chan *Message, n)
+		s.storer = func() {
+			store.Run(s.store)
+		}
+	}
+	if *issueIndex != "" {
+		index, err := OpenIssueIndex(*issueIndex, time.Duration(*issueIndexMaxAge)*time.Second)
+		if err != nil {
+			return fmt.Errorf("error opening issue index %s: %s", *issueIndex, err)
+		}
+		for kind, tracker := range s.trackers {
+			s.trackers[kind] = &dedupIssueTracker{IssueTracker: tracker, kind: kind, index: index}
+		}
+	}
+	s.incidents = &IncidentIndex{}
+	if *pagerdutyIndex != "" {
+		if s.incidents, err = OpenIncidentIndex(*pagerdutyIndex); err != nil {
+			return fmt.Errorf("error opening incident index %s: %s", *pagerdutyIndex, err)
+		}
+	}
+	setIncidents(s.Alerters, s.incidents)
 	if *gelfUdpPort > 0 {
-		s.routines = append(s.routines, func() {
-			ListenGelfUDP(*gelfUdpPort, s.in)
+		s.routines = append(s.routines, func(ctx context.Context) error {
+			return ListenGelfUDP(ctx, *gelfUdpPort, s.in)
 		})
 	}
 	if *gelfTcpPort > 0 {
-		s.routines = append(s.routines, func() {
-			ListenGelfTCP(*gelfTcpPort, s.in)
+		s.routines = append(s.routines, func(ctx context.Context) error {
+			return ListenGelfTCP(ctx, *gelfTcpPort, GelfTCPConfig{
+				Framing:     *gelfTcpFraming,
+				MaxSize:     *gelfTcpMaxSize,
+				IdleTimeout: time.Duration(*gelfTcpIdle) * time.Second,
+				TLS:         s.tlsConfig,
+			}, s.in)
 		})
 	}
 	if *gelfHTTPPort > 0 {
-		s.routines = append(s.routines, func() {
-			ListenGelfHTTP(*gelfHTTPPort, s.in)
+		s.routines = append(s.routines, func(ctx context.Context) error {
+			return ListenGelfHTTP(ctx, *gelfHTTPPort, *gelfHTTPMaxSize, s.tlsConfig, s.in)
+		})
+	}
+	if *syslogUdpPort > 0 {
+		s.routines = append(s.routines, func(ctx context.Context) error {
+			return ListenSyslogUDP(ctx, *syslogUdpPort, s.in)
+		})
+	}
+	if *syslogTcpPort > 0 {
+		s.routines = append(s.routines, func(ctx context.Context) error {
+			return ListenSyslogTCP(ctx, *syslogTcpPort,
+				time.Duration(*syslogTcpIdle)*time.Second, s.in)
 		})
 	}
 
+	if *adminHTTPPort > 0 {
+		s.routines = append(s.routines, func(ctx context.Context) error {
+			return ListenAdminHTTP(ctx, net.JoinHostPort(*adminAddress, strconv.Itoa(*adminHTTPPort)),
+				*adminToken, s.AdminHandler())
+		})
+	}
+	s.routines = append(s.routines, func(ctx context.Context) error {
+		s.watchReload(ctx, time.Duration(*reloadWatch)*time.Second)
+		return nil
+	})
+	if err = s.OpenDeadLetters(); err != nil {
+		return err
+	}
+	if *queueDir != "" {
+		if s.queue, err = OpenDiskQueue(*queueDir, DiskQueueConfig{
+			SegmentSize:   int64(*queueSegmentSize),
+			MaxSize:       int64(*queueMaxSize),
+			MaxAge:        time.Duration(*queueMaxAge) * time.Second,
+			Fsync:         *queueFsync,
+			FsyncInterval: time.Duration(*queueFsyncInterval) * time.Second,
+		}); err != nil {
+			return fmt.Errorf("error opening queue %s: %s", *queueDir, err)
+		}
+	}
+	return nil
+}
+
+// LoadFilters loads the filters TOML file, and builds the matchers, alerters
+// and rules from it. The returned error is a ConfigErrors if the file
+// is syntactically correct, but has semantic errors.
+func LoadFilters(filters string) (matchers map[string]Matcher, alerters map[string]Alerter, rules []Rule, err error) {
 	log.Printf("loading filters config file %s", filters)
-	tree, e := toml.LoadFile(filters)
-	if e != nil {
-		err = e
-		return
+	tree, err := toml.LoadFile(filters)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing %s: %s", filters, err)
 	}
-	log.Printf("building matchers from %s", tree.Get("filters"))
-	if s.Matchers, err = BuildMatchers(tree); err != nil {
-		return
+	var errs ConfigErrors
+	for _, k := range tree.Keys() {
+		if !(k == "filters" || k == "destinations" || k == "rules") {
+			errs.Add(tree, k, "unknown section %q", k)
+		}
 	}
-	log.Printf("matchers: %v", s.Matchers)
+	log.Printf("building matchers from %s", tree.Get("filters"))
+	matchers, e := BuildMatchers(tree)
+	errs.Append(e)
+	log.Printf("matchers: %v", matchers)
 
 	log.Printf("building destinations from %s", tree.Get("destinations"))
-	if s.Alerters, err = BuildAlerters(tree); err != nil {
-		return
+	alerters, e = BuildAlerters(tree)
+	errs.Append(e)
+	log.Printf("alerters: %v", alerters)
+
+	if len(errs) == 0 {
+		log.Printf("building rules")
+		rules, e = BuildRules(tree, matchers, alerters)
+		errs.Append(e)
+		recoveries, e := BuildRecoveryRules(tree, matchers, alerters)
+		errs.Append(e)
+		rules = append(rules, recoveries...)
+		log.Printf("rules: %v", rules)
+	}
+	if err = errs.InFile(filters).Err(); err != nil {
+		return nil, nil, nil, err
 	}
-	log.Printf("alerters: %v", s.Alerters)
+	return matchers, alerters, rules, nil
+}
 
-	log.Printf("building rules")
-	if s.Rules, err = BuildRules(tree, s.Matchers, s.Alerters); err != nil {
-		return
+// checkTransports checks that all the alerters have a configured transport,
+// and the fallback destination exists
+func (s *Server) checkTransports(alerters map[string]Alerter) error {
+	var errs ConfigErrors
+	if s.breaker.fallback != "" {
+		if _, ok := alerters[s.breaker.fallback]; !ok {
+			errs.AddAt(Position{}, "unknown breaker.fallback destination %q", s.breaker.fallback)
+		}
+	}
+	for k, al := range alerters {
+		switch a := al.(type) {
+		case emailAlert:
+			if s.email == nil {
+				errs.AddAt(Position{}, "destination %s: email needs smtp.hostport", k)
+			}
+		case smsAlert:
+			if s.sms == nil {
+				errs.AddAt(Position{}, "destination %s: sms needs twilio.sid", k)
+			}
+		case issueAlert:
+			if s.trackers[a.Kind] == nil {
+				errs.AddAt(Position{}, "destination %s: %s needs %s", k, a.Kind, issueSettings[a.Kind])
+			}
+		}
 	}
-	log.Printf("rules: %v", s.Rules)
+	return errs.Err()
+}
 
-	return s, nil
+// CheckConfig parses and checks the transports and filters TOML files,
+// without opening or starting anything
+func CheckConfig(transports, filters string) error {
+	_, err := ParseConfig(transports, filters)
+	return err
+}
+
+// Position is a position in a config file
+type Position struct {
+	Line, Col int
+}
+
+// positionTree is a ConfigTree which knows the position of its keys
+type positionTree interface {
+	GetPosition(key string) toml.Position
+}
+
+// position returns the position of the key in the tree, if known
+func position(tree ConfigTree, key string) Position {
+	if pt, ok := tree.(positionTree); ok {
+		if p := pt.GetPosition(key); !p.Invalid() {
+			return Position{Line: p.Line, Col: p.Col}
+		}
+	}
+	return Position{}
+}
+
+// ConfigError is a configuration error, with the position, if known
+type ConfigError struct {
+	File string
+	Position
+	Msg string
+}
+
+func (e ConfigError) Error() string {
+	prefix := e.File
+	if e.Line > 0 {
+		if prefix != "" {
+			prefix += ":"
+		}
+		prefix += fmt.Sprintf("%d:%d", e.Line, e.Col)
+	}
+	if prefix == "" {
+		return e.Msg
+	}
+	return prefix + ": " + e.Msg
+}
+
+// ConfigErrors is a list of configuration errors
+type ConfigErrors []ConfigError
+
+// Error returns the errors, one per line
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Err returns nil if there are no errors, else the errors sorted by position
+func (errs ConfigErrors) Err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Col < errs[j].Col
+	})
+	return errs
+}
+
+// Add adds an error for the key of the tree
+func (errs *ConfigErrors) Add(tree ConfigTree, key string, format string, args ...interface{}) {
+	errs.AddAt(position(tree, key), format, args...)
+}
+
+// AddAt adds an error at the position
+func (errs *ConfigErrors) AddAt(pos Position, format string, args ...interface{}) {
+	*errs = append(*errs, ConfigError{Position: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Append appends err (a ConfigErrors or any error) to the list
+func (errs *ConfigErrors) Append(err error) {
+	switch x := err.(type) {
+	case nil:
+	case ConfigErrors:
+		*errs = append(*errs, x...)
+	default:
+		*errs = append(*errs, ConfigError{Msg: err.Error()})
+	}
+}
+
+// InFile sets the file name of the errors
+func (errs ConfigErrors) InFile(name string) ConfigErrors {
+	for i := range errs {
+		errs[i].File = name
+	}
+	return errs
 }
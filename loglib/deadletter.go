@@ -0,0 +1,144 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a given up Delivery, stored with an ID
+type DeadLetter struct {
+	ID string `json:"id"`
+	Delivery
+}
+
+// DeadLetterStore stores the given up deliveries as JSON files in a directory
+type DeadLetterStore struct {
+	dir string
+	mu  sync.Mutex
+	seq uint32
+}
+
+const deadLetterSuffix = ".json"
+
+// OpenDeadLetterStore opens (creates) the dead-letter store in the directory
+func OpenDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &DeadLetterStore{dir: dir}, nil
+}
+
+func (dls *DeadLetterStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("bad dead letter id %q", id)
+	}
+	return filepath.Join(dls.dir, id+deadLetterSuffix), nil
+}
+
+// Put stores the delivery, returning its ID
+func (dls *DeadLetterStore) Put(d *Delivery) (string, error) {
+	dls.mu.Lock()
+	dls.seq++
+	id := fmt.Sprintf("%s-%06d", time.Now().UTC().Format("20060102T150405.000000"), dls.seq%1000000)
+	dls.mu.Unlock()
+	return id, dls.write(DeadLetter{ID: id, Delivery: *d})
+}
+
+// write writes the dead letter atomically
+func (dls *DeadLetterStore) write(dl DeadLetter) error {
+	fn, err := dls.path(dl.ID)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(fn+".tmp", b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// Get returns the dead letter with the given ID
+func (dls *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	fn, err := dls.path(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	dl := new(DeadLetter)
+	if err = json.Unmarshal(b, dl); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %s", fn, err)
+	}
+	dl.ID = id
+	return dl, nil
+}
+
+// List returns the IDs of the dead letters, oldest first
+func (dls *DeadLetterStore) List() ([]string, error) {
+	fis, err := ioutil.ReadDir(dls.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), deadLetterSuffix) {
+			ids = append(ids, strings.TrimSuffix(fi.Name(), deadLetterSuffix))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Delete deletes the dead letter
+func (dls *DeadLetterStore) Delete(id string) error {
+	fn, err := dls.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fn)
+}
+
+// Replay tries to send the dead letter again, with the Alerter of the
+// same named destination (narrowed to its recipient, if it has one),
+// without rate limiting. On success it is deleted,
+// else the attempt is recorded.
+func (s *Server) Replay(dls *DeadLetterStore, id string) error {
+	dl, err := dls.Get(id)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	al, ok := s.Alerters[dl.Destination]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: unknown destination %q", id, dl.Destination)
+	}
+	if dl.Recipient != "" {
+		al = forRecipient(al, dl.Recipient)
+	}
+	if err = sendAlert(al, dl.Rule, dl.Message, unlimitedSenders{s}); err != nil {
+		dl.Attempts = append(dl.Attempts, Attempt{Time: time.Now(), Error: err.Error()})
+		if e := dls.write(*dl); e != nil {
+			log.Printf("error updating %s: %s", id, e)
+		}
+		return fmt.Errorf("%s: %s", id, err)
+	}
+	return dls.Delete(id)
+}
@@ -0,0 +1,369 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Destination is a named Alerter, as the rules' Then contain them
+type Destination struct {
+	Name string
+	Alerter
+}
+
+// DeliveryConfig is the configuration of the per-destination delivery workers
+type DeliveryConfig struct {
+	// Workers is the number of concurrent senders per destination
+	Workers int
+	// QueueLen is the number of pending deliveries per destination,
+	// above it new ones are given up (dead-lettered) at once
+	QueueLen int
+	// MaxAttempts is the maximal number of tries of a delivery
+	MaxAttempts int
+	// MaxAge is the maximal time of retrying a delivery
+	MaxAge time.Duration
+	// BackoffMin and BackoffMax are the limits of the exponential backoff
+	BackoffMin, BackoffMax time.Duration
+}
+
+// Attempt is a failed delivery attempt
+type Attempt struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// Delivery is the sending of a message to a destination, because of a rule
+type Delivery struct {
+	Rule        string `json:"rule"`
+	Destination string `json:"destination"`
+	// Recipient is the recipient of the destination, if its recipients
+	// are delivered separately
+	Recipient string    `json:"recipient,omitempty"`
+	Message   *Message  `json:"message"`
+	Created   time.Time `json:"created"`
+	Attempts  []Attempt `json:"attempts,omitempty"`
+	alerter   Alerter
+	// ack is released when the delivery is finished
+	ack *pendingAck
+}
+
+// LastError returns the last attempt's error
+func (d *Delivery) LastError() string {
+	if len(d.Attempts) == 0 {
+		return ""
+	}
+	return d.Attempts[len(d.Attempts)-1].Error
+}
+
+// Deliverer sends the deliveries of one destination, with retries
+type Deliverer struct {
+	name     string
+	cfg      DeliveryConfig
+	jobs     chan *Delivery
+	provider SenderProvider
+	// retry is the SenderProvider for the retries: those must bypass
+	// the rate limiting, as the first attempt has already passed it
+	retry SenderProvider
+	// failed is called when a delivery is given up
+	failed func(*Delivery)
+	wg     sync.WaitGroup
+	// pending counts the deliveries not finished yet (queued or waiting for retry)
+	pending sync.WaitGroup
+
+	// mu guards retries and stopped
+	mu sync.Mutex
+	// retries are the timers of the deliveries waiting for retry
+	retries map[*Delivery]*time.Timer
+	stopped bool
+	// stop is closed when the deliveries are given up
+	stop chan struct{}
+}
+
+var (
+	// errShutdown is the error of the deliveries given up at shutdown
+	errShutdown = errors.New("not delivered before shutdown")
+	// errQueueFull is the error of the deliveries given up as the queue is full
+	errQueueFull = errors.New("delivery queue is full")
+)
+
+// NewDeliverer returns a new Deliverer for the named destination, and
+// starts its workers
+func NewDeliverer(name string, cfg DeliveryConfig, provider, retry SenderProvider, failed func(*Delivery)) *Deliverer {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueLen <= 0 {
+		cfg.QueueLen = 100
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.BackoffMin <= 0 {
+		cfg.BackoffMin = time.Second
+	}
+	if cfg.BackoffMax < cfg.BackoffMin {
+		cfg.BackoffMax = cfg.BackoffMin
+	}
+	d := &Deliverer{name: name, cfg: cfg, jobs: make(chan *Delivery, cfg.QueueLen),
+		provider: provider, retry: retry, failed: failed, stop: make(chan struct{})}
+	d.wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Enqueue puts the delivery into the queue, without blocking.
+// Returns false if the queue is full: then the delivery is given up.
+func (d *Deliverer) Enqueue(job *Delivery) bool {
+	d.pending.Add(1)
+	select {
+	case d.jobs <- job:
+		return true
+	default:
+		log.Printf("WARN delivery queue of %s is full, giving up %s", d.name, job.Message)
+		job.Attempts = append(job.Attempts, Attempt{Time: time.Now(), Error: errQueueFull.Error()})
+		if d.failed != nil {
+			d.failed(job)
+		}
+		d.finish(job)
+		return false
+	}
+}
+
+func (d *Deliverer) work() {
+	defer d.wg.Done()
+	for job := range d.jobs {
+		select {
+		case <-d.stop:
+			d.giveUp(job)
+		default:
+			d.try(job)
+		}
+	}
+}
+
+// try sends the delivery, and schedules a retry or gives up on error
+func (d *Deliverer) try(job *Delivery) {
+	provider := d.provider
+	if len(job.Attempts) > 0 {
+		provider = d.retry
+	}
+	err := sendAlert(job.alerter, job.Rule, job.Message, provider)
+	if err == nil {
+		if len(job.Attempts) > 0 {
+			log.Printf("delivered %s to %s after %d retries", job.Message, d.name, len(job.Attempts))
+		}
+		d.finish(job)
+		return
+	}
+	job.Attempts = append(job.Attempts, Attempt{Time: time.Now(), Error: err.Error()})
+	n := len(job.Attempts)
+	if n >= d.cfg.MaxAttempts || d.cfg.MaxAge > 0 && time.Since(job.Created) > d.cfg.MaxAge {
+		log.Printf("giving up delivering %s to %s after %d attempts: %s", job.Message, d.name, n, err)
+		if d.failed != nil {
+			d.failed(job)
+		}
+		d.finish(job)
+		return
+	}
+	wait := d.backoff(n)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		d.giveUp(job)
+		return
+	}
+	log.Printf("error delivering %s to %s (attempt %d): %s; retrying in %s", job.Message, d.name, n, err, wait)
+	if d.retries == nil {
+		d.retries = make(map[*Delivery]*time.Timer)
+	}
+	d.retries[job] = time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.retries, job)
+		// the timer may fire after Stop has started giving up
+		if d.stopped {
+			d.giveUp(job)
+			return
+		}
+		// the retry mustn't block the timer goroutine, nor be dropped
+		go func() {
+			select {
+			case d.jobs <- job:
+			case <-d.stop:
+				d.giveUp(job)
+			}
+		}()
+	})
+}
+
+// giveUp records the shutdown as the last attempt, and gives up the job
+func (d *Deliverer) giveUp(job *Delivery) {
+	job.Attempts = append(job.Attempts, Attempt{Time: time.Now(), Error: errShutdown.Error()})
+	if d.failed != nil {
+		d.failed(job)
+	}
+	d.finish(job)
+}
+
+// finish marks the job as finished (delivered or given up)
+func (d *Deliverer) finish(job *Delivery) {
+	job.ack.release()
+	d.pending.Done()
+}
+
+// Stop waits for the pending deliveries (with their retries) to finish
+// till ctx is done; then gives up the queued and the waiting ones,
+// and returns ctx's error
+func (d *Deliverer) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	d.mu.Lock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.stop)
+	}
+	var n int
+	for job, t := range d.retries {
+		if t.Stop() {
+			d.giveUp(job)
+			n++
+		}
+		delete(d.retries, job)
+	}
+	d.mu.Unlock()
+	for {
+		select {
+		case job := <-d.jobs:
+			d.giveUp(job)
+			n++
+			continue
+		default:
+		}
+		break
+	}
+	log.Printf("WARN gave up %d pending deliveries to %s at shutdown", n, d.name)
+	return ctx.Err()
+}
+
+// backoff returns the exponential backoff with jitter for the n-th retry:
+// a random duration between the half and the whole of min(BackoffMin*2^(n-1), BackoffMax)
+func (d *Deliverer) backoff(n int) time.Duration {
+	wait := d.cfg.BackoffMin
+	for i := 1; i < n && wait < d.cfg.BackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > d.cfg.BackoffMax {
+		wait = d.cfg.BackoffMax
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// unlimitedSenders is a SenderProvider without rate limiting
+type unlimitedSenders struct {
+	s *Server
+}
+
+func (u unlimitedSenders) GetSMSSender(string) SMSSender     { return u.s.sms }
+func (u unlimitedSenders) GetEmailSender(string) EmailSender { return u.s.email }
+func (u unlimitedSenders) GetIssueTracker(kind, _ string) IssueTracker {
+	return u.s.trackers[kind]
+}
+func (u unlimitedSenders) GetWebhookSender(string) WebhookSender { return u.s.webhook }
+
+// recipientAlerter is an Alerter sending to several recipients, which are
+// delivered (and retried) separately, so a partial failure does not
+// resend to the successful ones
+type recipientAlerter interface {
+	Alerter
+	Recipients() []string
+	ForRecipient(to string) Alerter
+}
+
+// forRecipient returns the alerter (possibly a Destination) narrowed
+// to the recipient
+func forRecipient(al Alerter, to string) Alerter {
+	if d, ok := al.(Destination); ok {
+		d.Alerter = forRecipient(d.Alerter, to)
+		return d
+	}
+	if ra, ok := al.(recipientAlerter); ok {
+		return ra.ForRecipient(to)
+	}
+	return al
+}
+
+// recipients returns the recipients to be delivered separately, if any
+func recipients(al Alerter) []string {
+	if d, ok := al.(Destination); ok {
+		al = d.Alerter
+	}
+	if ra, ok := al.(recipientAlerter); ok && len(ra.Recipients()) > 1 {
+		return ra.Recipients()
+	}
+	return nil
+}
+
+// deliver enqueues the sending of the message to the destination
+// into the destination's Deliverer, one per recipient if it has several;
+// ack is released when they are finished
+func (s *Server) deliver(rule string, al Alerter, m *Message, ack *pendingAck) {
+	name := "?"
+	if d, ok := al.(Destination); ok {
+		name = d.Name
+	}
+	s.deliverersMu.Lock()
+	d, ok := s.deliverers[name]
+	if !ok {
+		if s.deliverers == nil {
+			s.deliverers = make(map[string]*Deliverer)
+		}
+		d = NewDeliverer(name, s.deliveryConfig, s, unlimitedSenders{s}, s.deliveryFailed)
+		s.deliverers[name] = d
+	}
+	s.deliverersMu.Unlock()
+	now := time.Now()
+	tos := recipients(al)
+	if len(tos) == 0 {
+		ack.add()
+		d.Enqueue(&Delivery{Rule: rule, Destination: name, Message: m,
+			Created: now, alerter: al, ack: ack})
+		return
+	}
+	for _, to := range tos {
+		ack.add()
+		d.Enqueue(&Delivery{Rule: rule, Destination: name, Recipient: to, Message: m,
+			Created: now, alerter: forRecipient(al, to), ack: ack})
+	}
+}
+
+// deliveryFailed is called when a delivery is given up:
+// stores it in the dead letter store
+func (s *Server) deliveryFailed(d *Delivery) {
+	log.Printf("error doing %s for %s: %s", d.Rule, d.Destination, d.LastError())
+	if s.DeadLetters == nil {
+		return
+	}
+	if id, err := s.DeadLetters.Put(d); err != nil {
+		log.Printf("error storing dead letter: %s", err)
+	} else {
+		log.Printf("stored dead letter %s", id)
+	}
+}
@@ -7,97 +7,376 @@ package loglib
 import (
 	"bytes"
 	"encoding/json"
-	"io"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"strconv"
+	"strings"
 	"time"
 )
 
-// ElasticSearchPathPrefix is the path prefix storing data in ElasticSearch
-const ElasticSearchPathPrefix = "/woodchuck/gelf"
-
-// StoreCh is the channel for messages to be stored
-var StoreCh chan *Message
-
 // ElasticSearch context
 type ElasticSearch struct {
-	URL    *url.URL
-	client *http.Client
-}
-
-// {
-//    "ok" : true,
-//    "_index" : "twitter",
-//    "_type" : "tweet",
-//    "_id" : "6a8ca01c-7896-48e9-81cc-9f70661fcb32",
-//    "_version" : 1
-//}
-type esResponse struct {
-	Ok      bool   `json:"ok"`
-	Index   string `json:"_index"`
-	Type    string `json:"_type"`
-	ID      string `json:"_id"`
-	Version int    `json:"_version"`
-	Error   string `json:"error"`
-	Status  int    `json:"status"`
-}
-
-// NewElasticSearch returns a new ElasticSearch message store
-func NewElasticSearch(urls string, ttld int) *ElasticSearch {
+	URL *url.URL
+	// Index is the prefix of the daily indices: Index-2006.01.02
+	Index string
+	// Retention is the retention of the daily indices; the facilities
+	// with their own retention are written into Index-facility-2006.01.02
+	Retention Retention
+	// BulkConfig is the batching of the stored messages
+	BulkConfig BulkConfig
+	client     *http.Client
+}
+
+// NewElasticSearch returns a new ElasticSearch message store,
+// writing into the daily indices named index-YYYY.MM.DD
+func NewElasticSearch(urls, index string) (*ElasticSearch, error) {
 	u, err := url.Parse(urls)
 	if err != nil {
-		log.Fatalf("bad url %s: %s", urls, err)
-		return nil
+		return nil, fmt.Errorf("bad url %s: %s", urls, err)
 	}
-	if ttld > 0 {
-		q := u.Query()
-		q.Set("ttl", strconv.Itoa(ttld)+"d")
-		u.RawQuery = q.Encode()
+	if index == "" {
+		index = "woodchuck"
 	}
-	return &ElasticSearch{URL: u, client: http.DefaultClient}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &ElasticSearch{URL: u, Index: index, client: http.DefaultClient}, nil
 }
 
-// Store stores a message
-func (es ElasticSearch) Store(m *Message) (*esResponse, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, 512))
-	_, _ = io.WriteString(buf, `{"@timestamp": "`)
-	_, _ = io.WriteString(buf, time.Unix(m.TimeUnix, 0).Format(time.RFC3339))
-	_, _ = io.WriteString(buf, `", "gelf": `)
-	var (
-		resp *http.Response
-		err  error
-	)
-	if err = json.NewEncoder(buf).Encode(m); err != nil {
-		return nil, err
+// IndexName returns the name of the index of the facility for the day of t (in UTC)
+func (es *ElasticSearch) IndexName(facility string, t time.Time) string {
+	if len(es.Retention.Facilities) > 0 {
+		if f := indexFacility(facility); f != "" {
+			if _, ok := es.Retention.Facilities[f]; ok {
+				return es.Index + "-" + f + "-" + t.UTC().Format("2006.01.02")
+			}
+		}
+	}
+	return es.Index + "-" + t.UTC().Format("2006.01.02")
+}
+
+// esDoc is the stored document: the GELF fields, with the additional
+// fields under "extra" (without the leading underscore)
+type esDoc struct {
+	Timestamp string                 `json:"@timestamp"`
+	Version   string                 `json:"version,omitempty"`
+	Host      string                 `json:"host"`
+	Short     string                 `json:"short_message"`
+	Full      string                 `json:"full_message,omitempty"`
+	Level     int32                  `json:"level"`
+	Facility  string                 `json:"facility"`
+	File      string                 `json:"file,omitempty"`
+	Line      int                    `json:"line,omitempty"`
+	Extra     map[string]interface{} `json:"extra,omitempty"`
+}
+
+func newEsDoc(m *Message) esDoc {
+	doc := esDoc{Timestamp: time.Unix(m.TimeUnix, 0).UTC().Format(time.RFC3339),
+		Version: m.Version, Host: m.Host, Short: m.Short, Full: m.Full,
+		Level: m.Level, Facility: m.Facility, File: m.File, Line: m.Line}
+	if len(m.Extra) > 0 {
+		doc.Extra = make(map[string]interface{}, len(m.Extra))
+		for k, v := range m.Extra {
+			doc.Extra[strings.TrimPrefix(k, "_")] = v
+		}
+	}
+	return doc
+}
+
+// esTemplate is the index template of the daily indices
+const esTemplate = `{
+  "index_patterns": ["%s-*"],
+  "template": {
+    "mappings": {
+      "dynamic_templates": [
+        {"extra_strings": {
+          "path_match": "extra.*",
+          "match_mapping_type": "string",
+          "mapping": {"type": "keyword", "ignore_above": 1024}
+        }}
+      ],
+      "properties": {
+        "@timestamp": {"type": "date"},
+        "version": {"type": "keyword"},
+        "host": {"type": "keyword"},
+        "short_message": {"type": "text"},
+        "full_message": {"type": "text"},
+        "level": {"type": "byte"},
+        "facility": {"type": "keyword"},
+        "file": {"type": "keyword"},
+        "line": {"type": "integer"}
+      }
+    }
+  }
+}`
+
+// PutTemplate installs (replaces) the index template of the daily indices
+func (es *ElasticSearch) PutTemplate() error {
+	body := fmt.Sprintf(esTemplate, es.Index)
+	req, err := http.NewRequest("PUT", es.url("/_index_template/"+es.Index), strings.NewReader(body))
+	if err != nil {
+		return err
 	}
-	_, _ = buf.Write([]byte{'}'})
+	req.Header.Set("Content-Type", "application/json")
+	_, err = es.do(req)
+	return err
+}
+
+func (es *ElasticSearch) url(path string) string {
 	u := *es.URL
-	u.Path += ElasticSearchPathPrefix
-	if resp, err = es.client.Post(u.String(), "application/json",
-		bytes.NewReader(buf.Bytes())); err != nil {
+	u.Path += path
+	return u.String()
+}
+
+// do executes the request, returning the body of the response,
+// or an error if the status is not 2xx
+func (es *ElasticSearch) do(req *http.Request) ([]byte, error) {
+	resp, err := es.client.Do(req)
+	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	esR := new(esResponse)
-	if err = json.NewDecoder(resp.Body).Decode(esR); err != nil {
-		return esR, err
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		if len(b) > 1024 {
+			b = b[:1024]
+		}
+		return nil, &esError{Status: resp.StatusCode, Msg: string(b)}
+	}
+	return b, nil
+}
+
+// esError is an error response of ElasticSearch
+type esError struct {
+	Status int
+	Msg    string
+}
+
+func (e *esError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Msg)
+}
+
+// esRetryable returns whether the request can be retried after the error
+func esRetryable(err error) bool {
+	if e, ok := err.(*esError); ok {
+		return e.Status == http.StatusTooManyRequests || e.Status/100 == 5
+	}
+	return true // connection errors
+}
+
+// esBulkResponse is the response of _bulk, such as
+//
+//	{"took": 30, "errors": true, "items": [
+//	  {"index": {"_index": "woodchuck-2026.10.17", "_id": "...", "status": 201}},
+//	  {"index": {"status": 429, "error": {"type": "es_rejected_execution_exception", "reason": "..."}}}
+//	]}
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Index  string `json:"_index"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// esBulkItem is an encoded item of a bulk request
+type esBulkItem struct {
+	m    *Message
+	data []byte
+}
+
+func newEsBulkItem(es *ElasticSearch, m *Message) (esBulkItem, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 512))
+	fmt.Fprintf(buf, `{"index":{"_index":%q}}`+"\n", es.IndexName(m.Facility, time.Unix(m.TimeUnix, 0)))
+	if err := json.NewEncoder(buf).Encode(newEsDoc(m)); err != nil {
+		return esBulkItem{}, err
+	}
+	return esBulkItem{m: m, data: buf.Bytes()}, nil
+}
+
+// Bulk stores the items with one _bulk request. Returns the items which
+// failed with a retryable error (all of them if the request failed);
+// the others with errors are logged and dropped.
+func (es *ElasticSearch) Bulk(items []esBulkItem) ([]esBulkItem, error) {
+	var n int
+	for _, item := range items {
+		n += len(item.data)
+	}
+	body := bytes.NewBuffer(make([]byte, 0, n))
+	for _, item := range items {
+		body.Write(item.data)
+	}
+	req, err := http.NewRequest("POST", es.url("/_bulk"), body)
+	if err != nil {
+		return items, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	b, err := es.do(req)
+	if err != nil {
+		if !esRetryable(err) {
+			log.Printf("ERROR bulk request of %d messages rejected: %s", len(items), err)
+			return nil, nil
+		}
+		return items, err
+	}
+	var resp esBulkResponse
+	if err = json.Unmarshal(b, &resp); err != nil {
+		return items, fmt.Errorf("error decoding bulk response: %s", err)
+	}
+	if !resp.Errors {
+		return nil, nil
+	}
+	if len(resp.Items) != len(items) {
+		return items, fmt.Errorf("got %d bulk response items for %d messages", len(resp.Items), len(items))
+	}
+	var retry []esBulkItem
+	for i, ri := range resp.Items {
+		for _, r := range ri {
+			if r.Error == nil {
+				continue
+			}
+			if r.Status == http.StatusTooManyRequests || r.Status/100 == 5 {
+				retry = append(retry, items[i])
+				continue
+			}
+			log.Printf("ERROR storing %s: %d %s: %s", items[i].m, r.Status, r.Error.Type, r.Error.Reason)
+		}
+	}
+	if len(retry) > 0 {
+		return retry, fmt.Errorf("%d of %d messages failed", len(retry), len(items))
 	}
-	return esR, err
+	return nil, nil
+}
+
+// BulkConfig is the configuration of the batching of the stored messages
+type BulkConfig struct {
+	// Size is the maximal number of messages in one bulk request
+	Size int
+	// Bytes is the maximal size of one bulk request
+	Bytes int
+	// FlushInterval is the maximal time a message waits for storing
+	FlushInterval time.Duration
+	// MaxRetries is the number of retries of the failed messages
+	MaxRetries int
+}
+
+// Run stores the messages from the channel in batches, till it is closed
+func (es *ElasticSearch) Run(in <-chan *Message) {
+	storeEs(es, es.BulkConfig, in)
 }
 
-func storeEs(url string, ttld int, in <-chan *Message) {
-	es := NewElasticSearch(url, ttld)
+// storeEs stores the messages from the channel in batches, till it is closed;
+// then flushes the remaining ones
+func storeEs(es *ElasticSearch, cfg BulkConfig, in <-chan *Message) {
+	if cfg.Size <= 0 {
+		cfg.Size = 1000
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	templated := false
 	var (
-		resp *esResponse
-		err  error
+		items []esBulkItem
+		size  int
 	)
-	for m := range in {
-		if resp, err = es.Store(m); err != nil {
-			log.Printf("error storing message: %s", err)
-			continue
+	// flushing is held by the running flush, so the retries do not block
+	// the receiving: the messages are collected meanwhile, up to maxPending
+	flushing := make(chan struct{}, 1)
+	maxPending := 10 * cfg.Size
+	flush := func(wait bool) {
+		if wait {
+			flushing <- struct{}{}
+		} else {
+			select {
+			case flushing <- struct{}{}:
+			default:
+				return
+			}
+		}
+		batch := items
+		items, size = nil, 0
+		go func() {
+			defer func() { <-flushing }()
+			if !templated {
+				if err := es.PutTemplate(); err != nil {
+					log.Printf("error installing the index template: %s", err)
+				} else {
+					templated = true
+				}
+			}
+			for len(batch) > 0 {
+				n := bulkLen(batch, cfg)
+				es.flush(batch[:n], cfg.MaxRetries)
+				batch = batch[n:]
+			}
+		}()
+	}
+	ticker := time.NewTicker(cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				if len(items) > 0 {
+					flush(true)
+				}
+				// wait for the last flush
+				flushing <- struct{}{}
+				return
+			}
+			item, err := newEsBulkItem(es, m)
+			if err != nil {
+				log.Printf("error encoding %s: %s", m, err)
+				continue
+			}
+			items = append(items, item)
+			size += len(item.data)
+			if len(items) >= cfg.Size || cfg.Bytes > 0 && size >= cfg.Bytes {
+				flush(len(items) >= maxPending)
+			}
+		case <-ticker.C:
+			if len(items) > 0 {
+				flush(false)
+			}
+		}
+	}
+}
+
+// bulkLen returns the number of the first items fitting into one bulk request
+func bulkLen(items []esBulkItem, cfg BulkConfig) int {
+	var n, size int
+	for n < len(items) && n < cfg.Size &&
+		(n == 0 || cfg.Bytes <= 0 || size+len(items[n].data) <= cfg.Bytes) {
+		size += len(items[n].data)
+		n++
+	}
+	return n
+}
+
+// flush stores the items, retrying the failed ones with exponential backoff
+func (es *ElasticSearch) flush(items []esBulkItem, maxRetries int) {
+	wait := time.Second
+	for i := 0; len(items) > 0; i++ {
+		n := len(items)
+		var err error
+		if items, err = es.Bulk(items); err == nil {
+			log.Printf("stored %d messages", n)
+			return
+		}
+		if i >= maxRetries {
+			log.Printf("ERROR giving up storing %d messages: %s", len(items), err)
+			return
+		}
+		log.Printf("error storing %d messages: %s; retrying %d in %s", n, err, len(items), wait)
+		time.Sleep(wait)
+		if wait < time.Minute {
+			wait *= 2
 		}
-		log.Printf("message stored as %#v", resp)
 	}
 }
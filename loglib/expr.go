@@ -0,0 +1,503 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ExprError is a compile error of a filter expression
+type ExprError struct {
+	Col int // 1-based column, in runes
+	Msg string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Col, e.Msg)
+}
+
+// exprFilter is a Matcher of a compiled expression such as
+//
+//	level <= 3 && facility startsWith "wabard." && !(short contains "timeout")
+type exprFilter struct {
+	Source string
+	root   exprNode
+}
+
+// Match evaluates the compiled expression on the message
+func (f exprFilter) Match(m *Message) bool {
+	return truthy(f.root.eval(m))
+}
+
+func (f exprFilter) String() string {
+	return "expr(" + f.Source + ")"
+}
+
+// CompileExpr compiles the filter expression into a Matcher.
+//
+// Operands are the message fields (level, line, timestamp, host, facility,
+// short, full, file, version), "_" prefixed additional fields, "double quoted"
+// or `raw` strings, numbers, true and false.
+// Operators are ( ), !, &&, ||, ==, !=, <, <=, >, >=,
+// contains, startsWith, endsWith and matches (or =~, with a regexp literal).
+// A field missing from the message only satisfies !=.
+func CompileExpr(src string) (Matcher, error) {
+	p := &exprParser{lex: exprLexer{src: src}}
+	p.next()
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	if !root.isBool() {
+		return nil, &ExprError{Col: 1, Msg: "expression is not a condition"}
+	}
+	return exprFilter{Source: src, root: root}, nil
+}
+
+type tokKind uint8
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokKind
+	text string
+	col  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+type exprLexer struct {
+	src string
+	pos int
+}
+
+// next returns the next token
+func (l *exprLexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += size
+	}
+	start := l.pos
+	t := token{col: utf8.RuneCountInString(l.src[:start]) + 1}
+	if l.pos >= len(l.src) {
+		return t, nil
+	}
+	c := l.src[l.pos]
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	switch {
+	case r == '_' || unicode.IsLetter(r):
+		for l.pos < len(l.src) {
+			r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+			if !(r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				break
+			}
+			l.pos += size
+		}
+		t.kind = tokIdent
+	case c >= '0' && c <= '9' || c == '-' && l.pos+1 < len(l.src) && l.src[l.pos+1] >= '0' && l.src[l.pos+1] <= '9':
+		l.pos++
+		for l.pos < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[l.pos]) >= 0 {
+			if (l.src[l.pos] == '+' || l.src[l.pos] == '-') &&
+				!(l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E') {
+				break
+			}
+			l.pos++
+		}
+		t.kind = tokNumber
+	case c == '"' || c == '`':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != c {
+			if c == '"' && l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return t, &ExprError{Col: t.col, Msg: "unterminated string"}
+		}
+		l.pos++
+		s, err := strconv.Unquote(l.src[start:l.pos])
+		if err != nil {
+			return t, &ExprError{Col: t.col, Msg: "bad string " + l.src[start:l.pos]}
+		}
+		t.kind, t.text = tokString, s
+		return t, nil
+	case c == '(':
+		l.pos++
+		t.kind = tokLParen
+	case c == ')':
+		l.pos++
+		t.kind = tokRParen
+	default:
+		for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "<", ">", "!"} {
+			if strings.HasPrefix(l.src[l.pos:], op) {
+				l.pos += len(op)
+				t.kind = tokOp
+				break
+			}
+		}
+		if t.kind != tokOp {
+			return t, &ExprError{Col: t.col, Msg: fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	t.text = l.src[start:l.pos]
+	return t, nil
+}
+
+type exprParser struct {
+	lex exprLexer
+	tok token
+	err error
+}
+
+func (p *exprParser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return &ExprError{Col: p.tok.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	if p.err != nil {
+		return false
+	}
+	if p.tok.kind != tokOp && p.tok.kind != tokIdent {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinaryBool("||", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinaryBool("&&", p.parseUnary)
+}
+
+func (p *exprParser) parseBinaryBool(op string, sub func() (exprNode, error)) (exprNode, error) {
+	left, err := sub()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(op) {
+		col := p.tok.col
+		p.next()
+		right, err := sub()
+		if err != nil {
+			return nil, err
+		}
+		if !left.isBool() || !right.isBool() {
+			return nil, &ExprError{Col: col, Msg: op + " needs conditions on both sides"}
+		}
+		left = logicNode{op: op, left: left, right: right}
+	}
+	return left, p.err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!") {
+		col := p.tok.col
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if !x.isBool() {
+			return nil, &ExprError{Col: col, Msg: "! needs a condition"}
+		}
+		return notNode{x}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = []string{"==", "!=", "<", "<=", ">", ">=", "=~",
+	"contains", "startsWith", "endsWith", "matches"}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp(comparisonOps...) {
+		return left, p.err
+	}
+	op := p.tok.text
+	p.next()
+	rcol := p.tok.col
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "matches", "=~":
+		lit, ok := right.(literalNode)
+		s, isString := lit.v.(string)
+		if !ok || !isString {
+			return nil, &ExprError{Col: rcol, Msg: op + " needs a regexp string"}
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, &ExprError{Col: rcol, Msg: err.Error()}
+		}
+		return matchNode{left: left, re: re}, nil
+	}
+	return compareNode{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	t := p.tok
+	switch t.kind {
+	case tokLParen:
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("missing ) for ( at column %d", t.col)
+		}
+		p.next()
+		return parenNode{x}, p.err
+	case tokString:
+		p.next()
+		return literalNode{t.text}, p.err
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %s", t.text)
+		}
+		p.next()
+		return literalNode{f}, p.err
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return literalNode{t.text == "true"}, p.err
+		}
+		for _, op := range comparisonOps {
+			if t.text == op {
+				return nil, p.errorf("missing operand before %s", t.text)
+			}
+		}
+		if !(textFields[t.text] || numericFields[t.text] || isExtraField(t.text)) {
+			return nil, p.errorf("unknown field %q", t.text)
+		}
+		p.next()
+		return fieldNode(t.text), p.err
+	}
+	return nil, p.errorf("unexpected %s", t)
+}
+
+// exprNode is a node of the compiled expression
+type exprNode interface {
+	eval(m *Message) interface{}
+	// isBool returns whether the node can be used as a condition
+	isBool() bool
+}
+
+type literalNode struct {
+	v interface{}
+}
+
+func (n literalNode) eval(*Message) interface{} { return n.v }
+func (n literalNode) isBool() bool {
+	_, ok := n.v.(bool)
+	return ok
+}
+
+type fieldNode string
+
+func (n fieldNode) eval(m *Message) interface{} {
+	name := string(n)
+	switch name {
+	case "level":
+		return float64(m.Level)
+	case "line":
+		return float64(m.Line)
+	case "timestamp":
+		return float64(m.TimeUnix)
+	}
+	if textFields[name] {
+		s, _ := textField(m, name)
+		return s
+	}
+	if m.Extra == nil {
+		return nil
+	}
+	return m.Extra[name]
+}
+
+// an additional field can be a boolean
+func (n fieldNode) isBool() bool { return isExtraField(string(n)) }
+
+type parenNode struct {
+	exprNode
+}
+
+type notNode struct {
+	x exprNode
+}
+
+func (n notNode) eval(m *Message) interface{} { return !truthy(n.x.eval(m)) }
+func (n notNode) isBool() bool                { return true }
+
+type logicNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n logicNode) eval(m *Message) interface{} {
+	if n.op == "&&" {
+		return truthy(n.left.eval(m)) && truthy(n.right.eval(m))
+	}
+	return truthy(n.left.eval(m)) || truthy(n.right.eval(m))
+}
+func (n logicNode) isBool() bool { return true }
+
+type matchNode struct {
+	left exprNode
+	re   *regexp.Regexp
+}
+
+func (n matchNode) eval(m *Message) interface{} {
+	s, ok := exprString(n.left.eval(m))
+	return ok && n.re.MatchString(s)
+}
+func (n matchNode) isBool() bool { return true }
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n compareNode) isBool() bool { return true }
+
+func (n compareNode) eval(m *Message) interface{} {
+	a, b := n.left.eval(m), n.right.eval(m)
+	if a == nil || b == nil {
+		return n.op == "!="
+	}
+	switch n.op {
+	case "contains", "startsWith", "endsWith":
+		as, aok := exprString(a)
+		bs, bok := exprString(b)
+		if !(aok && bok) {
+			return false
+		}
+		switch n.op {
+		case "contains":
+			return strings.Contains(as, bs)
+		case "startsWith":
+			return strings.HasPrefix(as, bs)
+		}
+		return strings.HasSuffix(as, bs)
+	}
+	var c int
+	ab, aIsBool := a.(bool)
+	bb, bIsBool := b.(bool)
+	_, aIsString := a.(string)
+	_, bIsString := b.(string)
+	switch {
+	case aIsBool || bIsBool:
+		if !(aIsBool && bIsBool) || !(n.op == "==" || n.op == "!=") {
+			return n.op == "!="
+		}
+		return (ab == bb) == (n.op == "==")
+	case aIsString && bIsString:
+		c = strings.Compare(a.(string), b.(string))
+	default:
+		af, aok := asNumber(a)
+		bf, bok := asNumber(b)
+		if !(aok && bok) {
+			return n.op == "!="
+		}
+		switch {
+		case af < bf:
+			c = -1
+		case af > bf:
+			c = 1
+		}
+	}
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0 // ">="
+}
+
+// truthy returns whether the value is true (or "true")
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case string:
+		b, _ := strconv.ParseBool(x)
+		return b
+	}
+	return false
+}
+
+// exprString returns the string form of the value, false for missing
+func exprString(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return x, true
+	case []string:
+		return strings.Join(x, ","), true
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), true
+	}
+	return fmt.Sprintf("%v", v), true
+}
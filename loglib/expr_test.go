@@ -0,0 +1,83 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import "testing"
+
+func TestCompileExpr(t *testing.T) {
+	m := &Message{Level: 3, Facility: "wabard.x", Short: "all ok", Host: "höst",
+		Extra: map[string]interface{}{"_env": "prod", "_debug": true, "_code": 500.0, "_név": "é"}}
+	for i, tc := range []struct {
+		src  string
+		want bool
+	}{
+		// precedence: && binds tighter than ||
+		{`level == 1 && level == 2 || level == 3`, true},
+		{`level == 3 || level == 1 && level == 2`, true},
+		{`(level == 3 || level == 1) && level == 2`, false},
+		{`level == 1 && (level == 2 || level == 3)`, false},
+		// negation
+		{`!_debug`, false},
+		{`!!_debug`, true},
+		{`!(level == 1) && !(short contains "timeout")`, true},
+		{`!level == 3 || true`, true},
+		// literals
+		{`facility == "wabard.x"`, true},
+		{"facility == `wabard.x`", true},
+		{`short == "all \"ok\""`, false},
+		{`_code == 500 && _code == 5e2 && _code > -1 && _code < 500.5`, true},
+		{`_debug == true && _debug != false`, true},
+		{`level <= 3 && facility startsWith "wabard." && short endsWith "ok"`, true},
+		// regexps
+		{"facility matches `^wab\\w+\\.x$`", true},
+		{`facility =~ "^kobe"`, false},
+		// missing fields only satisfy !=
+		{`_missing != "x"`, true},
+		{`_missing == "x"`, false},
+		{`_missing < 1 || _missing >= 1`, false},
+		// non-ASCII fields and values
+		{`host == "höst" && _név == "é"`, true},
+	} {
+		mr, err := CompileExpr(tc.src)
+		if err != nil {
+			t.Errorf("%d. %s: %s", i, tc.src, err)
+			continue
+		}
+		if got := mr.Match(m); got != tc.want {
+			t.Errorf("%d. %s: got %t, wanted %t", i, tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	for i, tc := range []struct {
+		src string
+		col int
+	}{
+		{`level <= `, 10},
+		{`foo == 1`, 1},
+		{`level 3`, 7},
+		{`"a"`, 1},
+		{`(level == 1`, 12},
+		{`short matches "["`, 15},
+		{`level == "x`, 10},
+		{`level # 1`, 7},
+		{`!level`, 1},
+		{`level == 1 &&`, 14},
+		{`level == 1 || 2`, 12},
+		{`short == "é" && foo`, 17},
+		{`_név == "é" §`, 13},
+	} {
+		_, err := CompileExpr(tc.src)
+		ee, ok := err.(*ExprError)
+		if !ok {
+			t.Errorf("%d. %s: got %v, wanted an ExprError", i, tc.src, err)
+			continue
+		}
+		if ee.Col != tc.col {
+			t.Errorf("%d. %s: got column %d, wanted %d (%s)", i, tc.src, ee.Col, tc.col, ee.Msg)
+		}
+	}
+}
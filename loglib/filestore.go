@@ -0,0 +1,495 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a message store
+type Store interface {
+	// Run stores the messages from the channel, till it is closed
+	Run(in <-chan *Message)
+	// Search returns the stored messages matching the query, newest first
+	Search(q SearchQuery) (*SearchResult, error)
+	// DropExpired deletes the expired daily parts of the store, returning them.
+	// With dryRun, it just returns what would be deleted.
+	DropExpired(now time.Time, dryRun bool) ([]IndexInfo, error)
+}
+
+// FileStoreConfig is the configuration of the FileStore
+type FileStoreConfig struct {
+	// SegmentSize is the size of a segment file, above it a new one is started
+	SegmentSize int64
+	// MaxAge is the retention in days, 0 means forever
+	MaxAge int
+	// MaxSize is the maximal size of the store, the oldest days are dropped
+	// above it; 0 means unlimited
+	MaxSize int64
+	// BatchSize and FlushInterval limit the number of messages and the
+	// time they wait for writing as one block
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// FileStore is an embedded message store: in a directory per day
+// (2006.01.02), the messages are appended to segment files in gzip
+// compressed blocks of GELF JSON lines. Every segment has an index file,
+// with a JSON line per block holding its position and the time range,
+// levels, hosts and facilities of its messages, so the search reads only
+// the possibly matching blocks.
+type FileStore struct {
+	dir string
+	cfg FileStoreConfig
+
+	// mu guards the writes and deletes against the index reads
+	mu sync.RWMutex
+	// segs is the actual segment of the days written to
+	segs map[string]int
+}
+
+// fileBlock is an index entry: the position and the summary of a block
+type fileBlock struct {
+	Off        int64    `json:"off"`
+	Len        int64    `json:"len"`
+	Count      int      `json:"n"`
+	Min        int64    `json:"min"`
+	Max        int64    `json:"max"`
+	Levels     uint8    `json:"levels"`
+	Hosts      []string `json:"hosts"`
+	Facilities []string `json:"facilities"`
+}
+
+const (
+	fileStoreDayFormat = "2006.01.02"
+	fileStoreSegSuffix = ".seg"
+	fileStoreIdxSuffix = ".idx"
+)
+
+// OpenFileStore opens (creates) the file store in the directory
+func OpenFileStore(dir string, cfg FileStoreConfig) (*FileStore, error) {
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 64 << 20
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, cfg: cfg, segs: make(map[string]int)}, nil
+}
+
+// Run stores the messages from the channel in blocks, till it is closed;
+// then writes the remaining ones
+func (fs *FileStore) Run(in <-chan *Message) {
+	var batch []*Message
+	flush := func() {
+		if err := fs.Write(batch); err != nil {
+			log.Printf("error storing %d messages: %s", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	ticker := time.NewTicker(fs.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				if len(batch) > 0 {
+					flush()
+				}
+				return
+			}
+			if batch = append(batch, m); len(batch) >= fs.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flush()
+			}
+		}
+	}
+}
+
+// Write writes the messages, as a block per day
+func (fs *FileStore) Write(ms []*Message) error {
+	days := make(map[string][]*Message, 1)
+	for _, m := range ms {
+		day := time.Unix(m.TimeUnix, 0).UTC().Format(fileStoreDayFormat)
+		days[day] = append(days[day], m)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for day, ms := range days {
+		if err := fs.writeBlock(day, ms); err != nil {
+			return fmt.Errorf("%s: %s", day, err)
+		}
+	}
+	return nil
+}
+
+func (fs *FileStore) segPath(day string, seg int) string {
+	return filepath.Join(fs.dir, day, fmt.Sprintf("%06d", seg))
+}
+
+// writeBlock appends the messages to the actual segment of the day,
+// and its summary to the segment's index
+func (fs *FileStore) writeBlock(day string, ms []*Message) error {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gw)
+	block := fileBlock{Count: len(ms)}
+	hosts, facilities := make(map[string]struct{}), make(map[string]struct{})
+	for i, m := range ms {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		if i == 0 || m.TimeUnix < block.Min {
+			block.Min = m.TimeUnix
+		}
+		if i == 0 || m.TimeUnix > block.Max {
+			block.Max = m.TimeUnix
+		}
+		if m.Level >= 0 && m.Level < 8 {
+			block.Levels |= 1 << uint(m.Level)
+		}
+		hosts[m.Host], facilities[m.Facility] = struct{}{}, struct{}{}
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	block.Hosts, block.Facilities = setKeys(hosts), setKeys(facilities)
+
+	seg, ok := fs.segs[day]
+	if !ok {
+		var err error
+		if seg, err = fs.lastSegment(day); err != nil {
+			return err
+		}
+	}
+	base := fs.segPath(day, seg)
+	fi, err := os.Stat(base + fileStoreSegSuffix)
+	if err == nil && fi.Size() >= fs.cfg.SegmentSize {
+		seg++
+		base = fs.segPath(day, seg)
+	}
+	fs.segs[day] = seg
+	if err = os.MkdirAll(filepath.Dir(base), 0750); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(base+fileStoreSegSuffix, os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if block.Off, err = fh.Seek(0, io.SeekEnd); err == nil {
+		block.Len = int64(buf.Len())
+		_, err = fh.Write(buf.Bytes())
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	ih, err := os.OpenFile(base+fileStoreIdxSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = ih.Write(append(b, '\n'))
+	if closeErr := ih.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lastSegment returns the last segment of the day, cutting the data
+// after its last indexed block (written before a crash)
+func (fs *FileStore) lastSegment(day string) (int, error) {
+	names, _ := filepath.Glob(filepath.Join(fs.dir, day, "*"+fileStoreSegSuffix))
+	if len(names) == 0 {
+		return 1, nil
+	}
+	sort.Strings(names)
+	var seg int
+	base := strings.TrimSuffix(names[len(names)-1], fileStoreSegSuffix)
+	if _, err := fmt.Sscanf(filepath.Base(base), "%d", &seg); err != nil {
+		return 0, fmt.Errorf("bad segment name %s", base)
+	}
+	blocks, err := readFileBlocks(base + fileStoreIdxSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	var end int64
+	if len(blocks) > 0 {
+		end = blocks[len(blocks)-1].Off + blocks[len(blocks)-1].Len
+	}
+	if fi, err := os.Stat(base + fileStoreSegSuffix); err == nil && fi.Size() > end {
+		log.Printf("truncating %s to %d from %d", base+fileStoreSegSuffix, end, fi.Size())
+		if err = os.Truncate(base+fileStoreSegSuffix, end); err != nil {
+			return 0, err
+		}
+	}
+	return seg, nil
+}
+
+// readFileBlocks reads the index file, ignoring a partially written last line
+func readFileBlocks(fn string) ([]fileBlock, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []fileBlock
+	for _, line := range bytes.Split(b, []byte{'\n'}) {
+		var block fileBlock
+		if len(line) == 0 || json.Unmarshal(line, &block) != nil {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func setKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// days returns the day directories, oldest first
+func (fs *FileStore) days() ([]IndexInfo, error) {
+	fis, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []IndexInfo
+	for _, fi := range fis {
+		day, err := time.Parse(fileStoreDayFormat, fi.Name())
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		days = append(days, IndexInfo{Name: fi.Name(), Day: day})
+	}
+	return days, nil
+}
+
+// dayUsage returns the number of messages and the size of the day
+func (fs *FileStore) dayUsage(day string) (docs, size int64) {
+	names, _ := filepath.Glob(filepath.Join(fs.dir, day, "*"))
+	for _, fn := range names {
+		if fi, err := os.Stat(fn); err == nil {
+			size += fi.Size()
+		}
+		if strings.HasSuffix(fn, fileStoreIdxSuffix) {
+			blocks, _ := readFileBlocks(fn)
+			for _, block := range blocks {
+				docs += int64(block.Count)
+			}
+		}
+	}
+	return docs, size
+}
+
+// DropExpired deletes the days older than MaxAge, and the oldest days
+// (except today) while the store is bigger than MaxSize
+func (fs *FileStore) DropExpired(now time.Time, dryRun bool) ([]IndexInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	days, err := fs.days()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for i := range days {
+		days[i].Docs, days[i].Bytes = fs.dayUsage(days[i].Name)
+		total += days[i].Bytes
+	}
+	r := Retention{Days: fs.cfg.MaxAge}
+	today := now.UTC().Format(fileStoreDayFormat)
+	var dropped []IndexInfo
+	for _, info := range days {
+		if !r.Expired(info, now) &&
+			!(fs.cfg.MaxSize > 0 && total > fs.cfg.MaxSize && info.Name < today) {
+			continue
+		}
+		if !dryRun {
+			if err = os.RemoveAll(filepath.Join(fs.dir, info.Name)); err != nil {
+				return dropped, err
+			}
+			delete(fs.segs, info.Name)
+			retentionIndices.Add(1)
+			retentionDocs.Add(info.Docs)
+			retentionBytes.Add(info.Bytes)
+		}
+		total -= info.Bytes
+		dropped = append(dropped, info)
+	}
+	return dropped, nil
+}
+
+// Search returns the stored messages matching the query, newest first.
+// The text is searched as case-insensitive words, all of which must
+// be in the short or full message.
+func (fs *FileStore) Search(q SearchQuery) (*SearchResult, error) {
+	days, err := fs.days()
+	if err != nil {
+		return nil, err
+	}
+	words := strings.Fields(strings.ToLower(q.Text))
+	need := q.Offset + q.Limit
+	var (
+		total int64
+		found []*Message
+	)
+	for i := len(days) - 1; i >= 0; i-- {
+		day := days[i].Day
+		if !q.From.IsZero() && day.AddDate(0, 0, 1).Before(q.From) ||
+			!q.To.IsZero() && day.After(q.To) {
+			continue
+		}
+		idxs, _ := filepath.Glob(filepath.Join(fs.dir, days[i].Name, "*"+fileStoreIdxSuffix))
+		for _, idx := range idxs {
+			fs.mu.RLock()
+			blocks, err := readFileBlocks(idx)
+			fs.mu.RUnlock()
+			if err != nil {
+				if os.IsNotExist(err) { // dropped meanwhile
+					continue
+				}
+				return nil, err
+			}
+			seg := strings.TrimSuffix(idx, fileStoreIdxSuffix) + fileStoreSegSuffix
+			for _, block := range blocks {
+				if !q.blockMatch(block) {
+					continue
+				}
+				ms, err := readFileBlock(seg, block)
+				if err != nil {
+					log.Printf("error reading %s at %d: %s", seg, block.Off, err)
+					continue
+				}
+				for _, m := range ms {
+					if q.Match(m, words) {
+						total++
+						found = append(found, m)
+					}
+				}
+				if len(found) > 2*need+1000 {
+					found = newestMessages(found, need)
+				}
+			}
+		}
+	}
+	found = newestMessages(found, need)
+	if q.Offset < len(found) {
+		found = found[q.Offset:]
+	} else {
+		found = nil
+	}
+	if found == nil {
+		found = []*Message{}
+	}
+	return &SearchResult{Total: total, Messages: found}, nil
+}
+
+// newestMessages returns the newest n messages, newest first
+func newestMessages(ms []*Message, n int) []*Message {
+	sort.SliceStable(ms, func(i, j int) bool { return ms[i].TimeUnix > ms[j].TimeUnix })
+	if len(ms) > n {
+		ms = ms[:n]
+	}
+	return ms
+}
+
+// readFileBlock reads the messages of the block
+func readFileBlock(seg string, block fileBlock) ([]*Message, error) {
+	fh, err := os.Open(seg)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	gr, err := gzip.NewReader(io.NewSectionReader(fh, block.Off, block.Len))
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]*Message, 0, block.Count)
+	scanner := bufio.NewScanner(gr)
+	scanner.Buffer(make([]byte, 0, 4096), queueMaxRecordSz)
+	for scanner.Scan() {
+		m := new(Message)
+		if err = m.UnmarshalJSON(scanner.Bytes()); err != nil {
+			return ms, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, scanner.Err()
+}
+
+// blockMatch returns whether the block may have matching messages
+func (q SearchQuery) blockMatch(block fileBlock) bool {
+	if !q.From.IsZero() && block.Max < q.From.Unix() ||
+		!q.To.IsZero() && block.Min > q.To.Unix() {
+		return false
+	}
+	if q.Level >= 0 && block.Levels&(1<<uint(q.Level+1)-1) == 0 {
+		return false
+	}
+	contains := func(list []string, s string) bool {
+		i := sort.SearchStrings(list, s)
+		return i < len(list) && list[i] == s
+	}
+	return (q.Host == "" || contains(block.Hosts, q.Host)) &&
+		(q.Facility == "" || contains(block.Facilities, q.Facility))
+}
+
+// Match returns whether the message matches the query,
+// words being the lowercase words of the text
+func (q SearchQuery) Match(m *Message, words []string) bool {
+	if !q.From.IsZero() && m.TimeUnix < q.From.Unix() ||
+		!q.To.IsZero() && m.TimeUnix > q.To.Unix() ||
+		q.Level >= 0 && LogLevel(m.Level) > q.Level ||
+		q.Host != "" && m.Host != q.Host ||
+		q.Facility != "" && m.Facility != q.Facility {
+		return false
+	}
+	for k, v := range q.Extra {
+		x, ok := m.Extra["_"+k]
+		if !ok || fmt.Sprintf("%v", x) != v {
+			return false
+		}
+	}
+	if len(words) > 0 {
+		text := strings.ToLower(m.Short + "\n" + m.Full)
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				return false
+			}
+		}
+	}
+	return true
+}
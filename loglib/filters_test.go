@@ -0,0 +1,76 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRangeFilter(t *testing.T) {
+	for i, tc := range []struct {
+		field string
+		value interface{}
+		m     Message
+		want  bool
+	}{
+		{"level_lt", int64(3), Message{Level: 2}, true},
+		{"level_lt", int64(3), Message{Level: 3}, false},
+		{"level_le", int64(3), Message{Level: 3}, true},
+		{"level_le", int64(3), Message{Level: 4}, false},
+		{"level_gt", int64(3), Message{Level: 4}, true},
+		{"level_gt", int64(3), Message{Level: 3}, false},
+		{"level_ge", int64(3), Message{Level: 3}, true},
+		{"level_ge", int64(3), Message{Level: 2}, false},
+		{"level_eq", int64(3), Message{Level: 3}, true},
+		{"level_eq", int64(3), Message{Level: 2}, false},
+		{"level", int64(3), Message{Level: 3}, true},
+		{"level_ne", int64(3), Message{Level: 2}, true},
+		{"level_ne", int64(3), Message{Level: 3}, false},
+		{"line_between", []interface{}{int64(10), int64(20)}, Message{Line: 10}, true},
+		{"line_between", []interface{}{int64(10), int64(20)}, Message{Line: 20}, true},
+		{"line_between", []interface{}{int64(10), int64(20)}, Message{Line: 9}, false},
+		{"line_between", []interface{}{int64(10), int64(20)}, Message{Line: 21}, false},
+		{"_duration_ge", 1.5,
+			Message{Extra: map[string]interface{}{"_duration": 1.5}}, true},
+		{"_duration_ge", 1.5,
+			Message{Extra: map[string]interface{}{"_duration": json.Number("1.4")}}, false},
+		{"_duration_lt", 1.5,
+			Message{Extra: map[string]interface{}{"_duration": "1.2"}}, true},
+		// non-numeric and missing fields never match
+		{"_duration_lt", 1.5,
+			Message{Extra: map[string]interface{}{"_duration": "fast"}}, false},
+		{"_duration_ne", 1.5,
+			Message{Extra: map[string]interface{}{"_duration": true}}, false},
+		{"_duration_ne", 1.5, Message{}, false},
+	} {
+		f, err := newRangeFilter(tc.field, tc.value)
+		if err != nil {
+			t.Errorf("%d. %s: %s", i, tc.field, err)
+			continue
+		}
+		if got := f.Match(&tc.m); got != tc.want {
+			t.Errorf("%d. %s %v on %#v: got %t, wanted %t", i, tc.field, tc.value, tc.m, got, tc.want)
+		}
+	}
+}
+
+func TestRangeFilterErrors(t *testing.T) {
+	for i, tc := range []struct {
+		field string
+		value interface{}
+	}{
+		{"host_lt", int64(1)},
+		{"level_lt", "three"},
+		{"line_between", int64(1)},
+		{"line_between", []interface{}{int64(1)}},
+		{"line_between", []interface{}{int64(2), int64(1)}},
+		{"line_between", []interface{}{"a", int64(1)}},
+	} {
+		if _, err := newRangeFilter(tc.field, tc.value); err == nil {
+			t.Errorf("%d. %s %v: no error", i, tc.field, tc.value)
+		}
+	}
+}
@@ -65,9 +65,17 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 	return ((*gelf.Message)(m)).UnmarshalJSON(data)
 }
 
+// levelName returns the name of the level, or its number if unknown
+func levelName(level int32) string {
+	if level >= 0 && int(level) < len(LevelNames) {
+		return LevelNames[level]
+	}
+	return fmt.Sprintf("%d", level)
+}
+
 // String returns a short representation of the message
 func (m *Message) String() string {
-	return fmt.Sprintf("%s %s@%s: %s", LevelNames[m.Level], m.Facility, m.Host,
+	return fmt.Sprintf("%s %s@%s: %s", levelName(m.Level), m.Facility, m.Host,
 		m.Short)
 }
 
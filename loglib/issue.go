@@ -0,0 +1,478 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IssueTracker is an interface for an issue tracker injector
+type IssueTracker interface {
+	// NewIssue creates the issue, returning its key
+	NewIssue(Issue) (string, error)
+	// IsOpen returns whether the issue (created from issue) is still open;
+	// a deleted issue is closed
+	IsOpen(issue Issue, key string) (bool, error)
+	// AddNote adds a note (comment) to the issue (created from issue)
+	AddNote(issue Issue, key, note string) error
+}
+
+// Issue is an issue to be created. The trackers use the fields they know.
+type Issue struct {
+	// URL is the tracker's endpoint (Mantis)
+	URL string
+	// Project is the project name (Mantis), the project key (Jira),
+	// or the owner/repo (GitHub, Gitea)
+	Project string
+	// Category is the category (Mantis)
+	Category string
+	// Type is the issue type (Jira)
+	Type string
+	// Labels are the labels (Jira, GitHub, Gitea)
+	Labels []string
+	// Components are the components (Jira)
+	Components []string
+
+	Summary     string
+	Description string
+	// Fingerprint identifies the recurring issues, if not empty
+	Fingerprint string
+}
+
+// issueKeys are the destination keys of the issue trackers
+var issueKeys = map[string][]string{
+	"mantis": {"url", "project", "category", "fingerprint"},
+	"jira":   {"project", "issue_type", "labels", "components", "fingerprint"},
+	"github": {"repo", "labels", "fingerprint"},
+	"gitea":  {"repo", "labels", "fingerprint"},
+}
+
+// fields of the message the default fingerprint is derived from
+var defaultIssueFingerprint = []string{"facility", "short"}
+
+// issueSettings are the transport settings an issue tracker needs
+var issueSettings = map[string]string{
+	"jira":   "jira.url",
+	"github": "github.token",
+	"gitea":  "gitea.url",
+}
+
+type issueAlert struct {
+	// Kind is the kind of the tracker: mantis, jira, github or gitea
+	Kind  string
+	Issue Issue
+	// Fingerprint are the fields of the fingerprint of the recurring issues
+	Fingerprint []string
+}
+
+// Send creates an issue from the message, retrieving the IssueTracker
+// from the SenderProvider
+func (a issueAlert) Send(m *Message, s SenderProvider) error {
+	issue := a.Issue
+	issue.Summary, issue.Description = m.String(), m.Long()
+	issue.Fingerprint = a.fingerprint(m)
+	tracker := s.GetIssueTracker(a.Kind, a.Kind+" "+a.Issue.URL+a.Issue.Project+"#"+m.String())
+	if tracker == nil {
+		// rate limited: still count it for the note of the next occurrence
+		if c, ok := s.(issueCounter); ok {
+			c.countIssue(a.Kind, issue.Fingerprint)
+		}
+		return nil
+	}
+	key, err := tracker.NewIssue(issue)
+	if err == nil {
+		log.Printf("reported to %s issue %s", a.Kind, key)
+	}
+	return err
+}
+
+// issueCounter counts the occurrences of the issues not reported
+// because of the rate limit
+type issueCounter interface {
+	countIssue(kind, fingerprint string)
+}
+
+// fingerprint returns the fingerprint of the message's issue: the hash of
+// the tracker, the project and the Fingerprint fields of the message
+func (a issueAlert) fingerprint(m *Message) string {
+	hsh := sha256.New()
+	for _, v := range append([]string{a.Kind, a.Issue.URL, a.Issue.Project},
+		fieldValues(m, a.Fingerprint)...) {
+		hsh.Write([]byte(v))
+		hsh.Write([]byte{0})
+	}
+	return hex.EncodeToString(hsh.Sum(nil)[:16])
+}
+
+// buildIssue builds the issue alerter of the destination from the
+// [destinations.NAME.KIND] table, adding the errors to errs
+func buildIssue(name, kind string, tree ConfigTree, errs *ConfigErrors) (issueAlert, bool) {
+	a := issueAlert{Kind: kind, Fingerprint: defaultIssueFingerprint}
+	if kind == "jira" {
+		a.Issue.Type = "Bug"
+	}
+	n := len(*errs)
+	str := func(k string) string {
+		s, ok := tree.Get(k).(string)
+		if !ok {
+			errs.Add(tree, k, "destination %s: %s %s must be a string", name, kind, k)
+		}
+		return s
+	}
+	list := func(k string) []string {
+		arr, err := getList(tree, k)
+		if err != nil {
+			errs.Add(tree, k, "destination %s: %s %s", name, kind, err)
+		}
+		return arr
+	}
+	for _, k := range tree.Keys() {
+		if !hasString(issueKeys[kind], k) {
+			errs.Add(tree, k, "destination %s: unsupported %s key %q", name, kind, k)
+			continue
+		}
+		switch k {
+		case "url":
+			a.Issue.URL = str(k)
+		case "project", "repo":
+			a.Issue.Project = str(k)
+		case "category":
+			a.Issue.Category = str(k)
+		case "issue_type":
+			a.Issue.Type = str(k)
+		case "labels":
+			a.Issue.Labels = list(k)
+		case "components":
+			a.Issue.Components = list(k)
+		case "fingerprint":
+			if a.Fingerprint = list(k); len(a.Fingerprint) == 0 {
+				errs.Add(tree, k, "destination %s: %s fingerprint is empty", name, kind)
+			}
+		}
+	}
+	switch kind {
+	case "mantis":
+		if u, err := url.Parse(a.Issue.URL); a.Issue.URL == "" || err != nil || u.Host == "" {
+			errs.Add(tree, "url", "destination %s: mantis needs an URL, got %q", name, a.Issue.URL)
+		}
+	case "jira":
+		if a.Issue.Project == "" {
+			errs.Add(tree, "project", "destination %s: jira needs a project", name)
+		}
+	default:
+		if i := strings.IndexByte(a.Issue.Project, '/'); i <= 0 || i == len(a.Issue.Project)-1 ||
+			strings.Count(a.Issue.Project, "/") != 1 {
+			errs.Add(tree, "repo", "destination %s: %s needs a repo as owner/name, got %q",
+				name, kind, a.Issue.Project)
+		}
+	}
+	return a, len(*errs) == n
+}
+
+// hasString returns whether the list contains s
+func hasString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate returns the first line of s, at most n runes long
+func truncate(s string, n int) string {
+	if i := strings.IndexAny(s, "\r\n"); i >= 0 {
+		s = s[:i]
+	}
+	if r := []rune(s); len(r) > n {
+		s = string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// statusError is the error of a non-2xx response
+type statusError struct {
+	Code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// isGone returns whether the error is a 404 Not Found or 410 Gone response
+func isGone(err error) bool {
+	se, ok := err.(*statusError)
+	return ok && (se.Code == http.StatusNotFound || se.Code == http.StatusGone)
+}
+
+// doJSON sends the JSON encoded in (if not nil) with the request,
+// and decodes the response into out (if not nil).
+// Non-2xx responses are returned as errors.
+func doJSON(client *http.Client, method, uri string, header http.Header, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", "woodchuck")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{Code: resp.StatusCode, msg: fmt.Sprintf("%s %s: %s: %s",
+			method, redactURL(uri), resp.Status, bytes.TrimSpace(b))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding the response of %s: %s", redactURL(uri), err)
+	}
+	return nil
+}
+
+// jiraTracker creates the issues with the Jira REST API
+type jiraTracker struct {
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+// NewJiraTracker returns a Jira IssueTracker. With username, the token is
+// used as the password (API token) of Basic Auth, else as a Bearer token
+// (personal access token).
+func NewJiraTracker(baseURL, username, token string, timeout time.Duration) IssueTracker {
+	header := make(http.Header, 1)
+	if username != "" {
+		header.Set("Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(username+":"+token)))
+	} else if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return jiraTracker{url: strings.TrimRight(baseURL, "/"), header: header,
+		client: &http.Client{Timeout: timeout}}
+}
+
+// NewIssue creates the issue in the project, returning its key
+func (jt jiraTracker) NewIssue(issue Issue) (string, error) {
+	type named struct {
+		Name string `json:"name,omitempty"`
+		Key  string `json:"key,omitempty"`
+	}
+	fields := map[string]interface{}{
+		"project":     named{Key: issue.Project},
+		"issuetype":   named{Name: issue.Type},
+		"summary":     truncate(issue.Summary, 255),
+		"description": "{noformat}\n" + issue.Description + "\n{noformat}",
+	}
+	if len(issue.Labels) > 0 {
+		fields["labels"] = issue.Labels
+	}
+	if len(issue.Components) > 0 {
+		components := make([]named, len(issue.Components))
+		for i, c := range issue.Components {
+			components[i].Name = c
+		}
+		fields["components"] = components
+	}
+	var resp struct {
+		Key string `json:"key"`
+	}
+	if err := doJSON(jt.client, "POST", jt.url+"/rest/api/2/issue", jt.header,
+		map[string]interface{}{"fields": fields}, &resp); err != nil {
+		return "", err
+	}
+	return resp.Key, nil
+}
+
+// IsOpen returns whether the issue's status is not in the done category
+func (jt jiraTracker) IsOpen(issue Issue, key string) (bool, error) {
+	var resp struct {
+		Fields struct {
+			Status struct {
+				Category struct {
+					Key string `json:"key"`
+				} `json:"statusCategory"`
+			} `json:"status"`
+		} `json:"fields"`
+	}
+	if err := doJSON(jt.client, "GET", jt.url+"/rest/api/2/issue/"+url.PathEscape(key)+"?fields=status",
+		jt.header, nil, &resp); err != nil {
+		if isGone(err) { // deleted or moved: treat it as closed
+			return false, nil
+		}
+		return false, err
+	}
+	return resp.Fields.Status.Category.Key != "done", nil
+}
+
+// AddNote adds the note as a comment to the issue
+func (jt jiraTracker) AddNote(issue Issue, key, note string) error {
+	return doJSON(jt.client, "POST", jt.url+"/rest/api/2/issue/"+url.PathEscape(key)+"/comment",
+		jt.header, map[string]string{"body": "{noformat}\n" + note + "\n{noformat}"}, nil)
+}
+
+// githubTracker creates the issues with the GitHub or Gitea REST API
+type githubTracker struct {
+	url    string
+	gitea  bool
+	header http.Header
+	client *http.Client
+
+	mu sync.Mutex
+	// labels are the label IDs by name by repo (Gitea)
+	labels map[string]map[string]int64
+}
+
+// NewGithubTracker returns a GitHub IssueTracker, baseURL is the API's URL
+func NewGithubTracker(baseURL, token string, timeout time.Duration) IssueTracker {
+	header := make(http.Header, 2)
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("X-GitHub-Api-Version", "2022-11-28")
+	return &githubTracker{url: strings.TrimRight(baseURL, "/"), header: header,
+		client: &http.Client{Timeout: timeout}}
+}
+
+// NewGiteaTracker returns a Gitea IssueTracker, baseURL is the server's URL
+func NewGiteaTracker(baseURL, token string, timeout time.Duration) IssueTracker {
+	header := make(http.Header, 1)
+	if token != "" {
+		header.Set("Authorization", "token "+token)
+	}
+	return &githubTracker{url: strings.TrimRight(baseURL, "/") + "/api/v1", gitea: true,
+		header: header, client: &http.Client{Timeout: timeout}}
+}
+
+// NewIssue creates the issue in the owner/repo project, returning its number
+func (gt *githubTracker) NewIssue(issue Issue) (string, error) {
+	req := map[string]interface{}{
+		"title": truncate(issue.Summary, 256),
+		"body":  "```\n" + issue.Description + "\n```",
+	}
+	if len(issue.Labels) > 0 {
+		if !gt.gitea {
+			req["labels"] = issue.Labels
+		} else {
+			ids, err := gt.labelIDs(issue.Project, issue.Labels)
+			if err != nil {
+				return "", err
+			}
+			req["labels"] = ids
+		}
+	}
+	var resp struct {
+		Number int64 `json:"number"`
+	}
+	if err := doJSON(gt.client, "POST", gt.url+"/repos/"+issue.Project+"/issues", gt.header,
+		req, &resp); err != nil {
+		return "", err
+	}
+	return issue.Project + "#" + strconv.FormatInt(resp.Number, 10), nil
+}
+
+// issueURL returns the API URL of the owner/repo#number issue key
+func (gt *githubTracker) issueURL(key string) (string, error) {
+	i := strings.LastIndexByte(key, '#')
+	if i < 0 {
+		return "", fmt.Errorf("bad issue key %q", key)
+	}
+	if _, err := strconv.ParseInt(key[i+1:], 10, 64); err != nil {
+		return "", fmt.Errorf("bad issue number in %q", key)
+	}
+	return gt.url + "/repos/" + key[:i] + "/issues/" + key[i+1:], nil
+}
+
+// IsOpen returns whether the issue's state is open
+func (gt *githubTracker) IsOpen(issue Issue, key string) (bool, error) {
+	uri, err := gt.issueURL(key)
+	if err != nil {
+		return false, err
+	}
+	var resp struct {
+		State string `json:"state"`
+	}
+	if err = doJSON(gt.client, "GET", uri, gt.header, nil, &resp); err != nil {
+		if isGone(err) { // deleted or transferred: treat it as closed
+			return false, nil
+		}
+		return false, err
+	}
+	return resp.State == "open", nil
+}
+
+// AddNote adds the note as a comment to the issue
+func (gt *githubTracker) AddNote(issue Issue, key, note string) error {
+	uri, err := gt.issueURL(key)
+	if err != nil {
+		return err
+	}
+	return doJSON(gt.client, "POST", uri+"/comments", gt.header,
+		map[string]string{"body": "```\n" + note + "\n```"}, nil)
+}
+
+// labelIDs returns the IDs of the labels of the repo, as Gitea needs IDs
+func (gt *githubTracker) labelIDs(repo string, names []string) ([]int64, error) {
+	gt.mu.Lock()
+	defer gt.mu.Unlock()
+	byName, ok := gt.labels[repo]
+	if !ok {
+		var labels []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		}
+		if err := doJSON(gt.client, "GET", gt.url+"/repos/"+repo+"/labels?limit=100",
+			gt.header, nil, &labels); err != nil {
+			return nil, fmt.Errorf("error listing the labels of %s: %s", repo, err)
+		}
+		byName = make(map[string]int64, len(labels))
+		for _, l := range labels {
+			byName[l.Name] = l.ID
+		}
+		if gt.labels == nil {
+			gt.labels = make(map[string]map[string]int64)
+		}
+		gt.labels[repo] = byName
+	}
+	ids := make([]int64, 0, len(names))
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			log.Printf("unknown label %q of %s", name, repo)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IssueRecord is the issue reported for a fingerprint
+type IssueRecord struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+	// Count is the number of the reported occurrences
+	Count int       `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// IssueIndex is the fingerprint → issue map, persisted in a JSON file
+type IssueIndex struct {
+	path string
+	// maxAge is the age of the last occurrence, when the record is pruned
+	maxAge time.Duration
+	mu     sync.Mutex
+	issues map[string]IssueRecord
+}
+
+// OpenIssueIndex opens the issue index file (which need not exist),
+// which forgets the fingerprints not occurred for maxAge (if positive)
+func OpenIssueIndex(path string, maxAge time.Duration) (*IssueIndex, error) {
+	ix := &IssueIndex{path: path, maxAge: maxAge, issues: make(map[string]IssueRecord)}
+	if err := readJSONFile(path, &ix.issues); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// Get returns the issue of the fingerprint
+func (ix *IssueIndex) Get(fingerprint string) (IssueRecord, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	rec, ok := ix.issues[fingerprint]
+	return rec, ok
+}
+
+// Put stores the issue of the fingerprint, prunes the old records,
+// and writes the index atomically
+func (ix *IssueIndex) Put(fingerprint string, rec IssueRecord) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.issues[fingerprint] = rec
+	ix.prune()
+	return writeJSONFile(ix.path, ix.issues)
+}
+
+// Delete deletes the issue of the fingerprint (found closed)
+func (ix *IssueIndex) Delete(fingerprint string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if _, ok := ix.issues[fingerprint]; !ok {
+		return nil
+	}
+	delete(ix.issues, fingerprint)
+	ix.prune()
+	return writeJSONFile(ix.path, ix.issues)
+}
+
+// prune deletes the records whose last occurrence is older than maxAge
+func (ix *IssueIndex) prune() {
+	if ix.maxAge <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-ix.maxAge)
+	for fp, rec := range ix.issues {
+		if rec.Last.Before(deadline) {
+			delete(ix.issues, fp)
+		}
+	}
+}
+
+// Count counts an occurrence of the fingerprint's issue, if it has one,
+// which is not reported (written with the next Put)
+func (ix *IssueIndex) Count(fingerprint string, now time.Time) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	rec, ok := ix.issues[fingerprint]
+	if !ok {
+		return false
+	}
+	rec.Count++
+	rec.Last = now
+	ix.issues[fingerprint] = rec
+	return true
+}
+
+// readJSONFile decodes the JSON file into v, creating its directory
+// if the file does not exist
+func readJSONFile(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return os.MkdirAll(filepath.Dir(path), 0750)
+		}
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error decoding %s: %s", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile writes v as JSON into the file atomically
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path+".tmp", b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// dedupIssueTracker adds a note to the still open issue of the fingerprint,
+// instead of creating a new issue
+type dedupIssueTracker struct {
+	IssueTracker
+	kind  string
+	index *IssueIndex
+	// mu serializes the reports, so a fingerprint gets only one issue
+	mu sync.Mutex
+}
+
+// NewIssue adds a note with the occurrence count and the issue's description
+// to the open issue of the same fingerprint, or creates a new issue
+func (dt *dedupIssueTracker) NewIssue(issue Issue) (string, error) {
+	if issue.Fingerprint == "" {
+		return dt.IssueTracker.NewIssue(issue)
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	now := time.Now().UTC()
+	if rec, ok := dt.index.Get(issue.Fingerprint); ok {
+		open, err := dt.IssueTracker.IsOpen(issue, rec.Key)
+		if err != nil {
+			return "", fmt.Errorf("error checking issue %s: %s", rec.Key, err)
+		}
+		if open {
+			rec.Count++
+			rec.Last = now
+			note := fmt.Sprintf("Occurred again, %d times since %s. Latest:\n\n%s",
+				rec.Count, rec.First.Format(time.RFC3339), issue.Description)
+			if err = dt.IssueTracker.AddNote(issue, rec.Key, note); err != nil {
+				return "", fmt.Errorf("error adding note to issue %s: %s", rec.Key, err)
+			}
+			if err = dt.index.Put(issue.Fingerprint, rec); err != nil {
+				log.Printf("error storing issue %s: %s", rec.Key, err)
+			}
+			return rec.Key, nil
+		}
+		log.Printf("issue %s is closed, creating a new one", rec.Key)
+		if err = dt.index.Delete(issue.Fingerprint); err != nil {
+			log.Printf("error deleting issue %s: %s", rec.Key, err)
+		}
+	}
+	key, err := dt.IssueTracker.NewIssue(issue)
+	if err != nil || key == "" {
+		return key, err
+	}
+	// the issue is created, so do not return an error (causing a retry)
+	if err = dt.index.Put(issue.Fingerprint, IssueRecord{Kind: dt.kind, Key: key,
+		Count: 1, First: now, Last: now}); err != nil {
+		log.Printf("error storing issue %s: %s", key, err)
+	}
+	return key, nil
+}
+
+// count counts the not reported occurrence of the fingerprint's issue
+func (dt *dedupIssueTracker) count(fingerprint string) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.index.Count(fingerprint, time.Now().UTC())
+}
@@ -0,0 +1,27 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package loglib
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file, and locks it exclusively with flock
+// (released when the file is closed, or the process exits)
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -5,39 +5,291 @@
 package loglib
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-// Start starts the needed support goroutines
-func (s *Server) Start() {
+// Start starts the needed support goroutines (the listeners and the
+// config watcher), which stop when ctx is done, and the storage goroutine
+func (s *Server) Start(ctx context.Context) {
 	for i, fun := range s.routines {
-		go fun()
+		s.routinesWg.Add(1)
+		go func(fun func(context.Context) error) {
+			defer s.routinesWg.Done()
+			if err := fun(ctx); err != nil {
+				log.Printf("ERROR %s", err)
+			}
+		}(fun)
 		s.routines[i] = nil
 	}
 	s.routines = nil
+	if s.storer != nil {
+		s.stored = make(chan struct{})
+		go func() {
+			defer close(s.stored)
+			s.storer()
+		}()
+	}
 }
 
-// Serve receives messages
+// Serve receives and processes messages till SIGTERM or SIGINT,
+// then shuts down gracefully.
 func (s *Server) Serve() {
-	s.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case got := <-sig:
+			log.Printf("got %s", got)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := s.Run(ctx); err != nil {
+		log.Printf("error shutting down: %s", err)
+	}
+}
+
+// Run starts the goroutines and processes the messages till ctx is done,
+// then shuts down, waiting at most shutdown.timeout for the drain.
+func (s *Server) Run(ctx context.Context) error {
+	lctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.Start(lctx)
+	s.served = make(chan struct{})
+	if s.queue != nil {
+		s.acked = make(chan struct{})
+	}
+	go func() {
+		defer close(s.served)
+		s.loop()
+	}()
+	select {
+	case <-ctx.Done():
+		log.Printf("shutting down: %s", ctx.Err())
+	case <-s.served:
+		log.Printf("processing stopped, shutting down")
+	}
+	sctx, scancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer scancel()
+	return s.Shutdown(sctx)
+}
 
-	var rule Rule
+// Shutdown stops the listeners, drains the messages already received
+// through the rules and the store, and waits for the pending deliveries.
+// When ctx is done, it gives up: the not yet processed messages stay in the
+// disk queue (if any), the pending deliveries go to the dead letters.
+func (s *Server) Shutdown(ctx context.Context) error {
 	var err error
+	s.shutdownOnce.Do(func() { err = s.shutdown(ctx) })
+	return err
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	listening := make(chan struct{})
+	go func() {
+		s.routinesWg.Wait()
+		close(listening)
+	}()
+	// the listeners may send into s.in till they return
+	stopped := waitFor(ctx, listening)
+	if stopped {
+		close(s.in)
+	} else {
+		log.Printf("WARN listeners haven't stopped in time")
+	}
+	served := s.served == nil
+	if stopped && s.served != nil {
+		served = waitFor(ctx, s.served)
+	}
+	if !served {
+		log.Printf("WARN processing hasn't finished in time")
+		if s.queue != nil {
+			// stops the processing, the rest is replayed on next start
+			s.queue.Close()
+		}
+	} else if s.store != nil {
+		// process sends into s.store, so it can be closed only after it
+		close(s.store)
+		if s.stored != nil && !waitFor(ctx, s.stored) {
+			log.Printf("WARN storing hasn't finished in time")
+		}
+	}
+
+	s.deliverersMu.Lock()
+	deliverers := make([]*Deliverer, 0, len(s.deliverers))
+	for _, d := range s.deliverers {
+		deliverers = append(deliverers, d)
+	}
+	s.deliverersMu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(len(deliverers))
+	for _, d := range deliverers {
+		go func(d *Deliverer) {
+			defer wg.Done()
+			d.Stop(ctx)
+		}(d)
+	}
+	wg.Wait()
+
+	if s.acked != nil && !waitFor(ctx, s.acked) {
+		log.Printf("WARN acknowledging hasn't finished in time")
+	}
+	if s.queue != nil {
+		if err := s.queue.Close(); err != nil {
+			log.Printf("error closing queue: %s", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("shut down cleanly")
+	return nil
+}
+
+// waitFor waits for done to be closed, or ctx to be done;
+// returns whether done has been closed
+func waitFor(ctx context.Context, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// loop receives the messages till s.in is closed. With a disk queue,
+// the listeners' messages go through it, and are acknowledged after all
+// their deliveries are finished (delivered or given up).
+func (s *Server) loop() {
+	if s.queue == nil {
+		for m := range s.in {
+			s.process(m, nil)
+		}
+		return
+	}
+	go func() {
+		s.queue.Fill(s.in)
+		s.queue.Drain()
+	}()
+	acks := make(chan *pendingAck)
+	go func(acked chan struct{}) {
+		if acked != nil {
+			defer close(acked)
+		}
+		s.ackInOrder(acks)
+	}(s.acked)
+	defer close(acks)
+	for {
+		m, pos, err := s.queue.Get()
+		if err != nil {
+			if err == ErrQueueClosed || err == ErrQueueDrained {
+				return
+			}
+			log.Printf("error reading queue: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		p := &pendingAck{pos: pos, n: 1, done: make(chan struct{})}
+		s.process(m, p)
+		acks <- p
+		p.release()
+	}
+}
+
+// pendingAck is a message of the disk queue, to be acknowledged when
+// its processing and all of its deliveries are finished
+type pendingAck struct {
+	pos QueuePos
+	// n is the number of the unfinished parts
+	n    int32
+	done chan struct{}
+}
+
+func (p *pendingAck) add() {
+	if p != nil {
+		atomic.AddInt32(&p.n, 1)
+	}
+}
 
-	for m := range s.in {
-		if s.store != nil {
-			s.store <- m
+// release finishes a part, closing done after the last
+func (p *pendingAck) release() {
+	if p != nil && atomic.AddInt32(&p.n, -1) == 0 {
+		close(p.done)
+	}
+}
+
+// ackInOrder acknowledges the messages in the order of the queue,
+// as the acknowledgement covers all the preceding messages, till acks is
+// closed and all its messages are finished
+func (s *Server) ackInOrder(acks <-chan *pendingAck) {
+	var waiting []*pendingAck
+	for acks != nil || len(waiting) > 0 {
+		var head <-chan struct{}
+		if len(waiting) > 0 {
+			head = waiting[0].done
 		}
-		log.Printf("got %#v", m)
-		if LogLevel(m.Level) <= ERROR {
-			log.Printf("ERROR from %s@%s: %s\n%s", m.Facility, m.Host, m.Short, m.Full)
+		select {
+		case p, ok := <-acks:
+			if !ok {
+				acks = nil
+				continue
+			}
+			waiting = append(waiting, p)
+			continue
+		case <-head:
 		}
-		for _, rule = range s.Rules {
-			if rule.Match(m) {
-				log.Printf("rule %s matches %s", rule, m)
-				if err = rule.Do(m, s); err != nil {
-					log.Printf("error doing %s: %s", rule, err)
-				}
+		var pos QueuePos
+		for len(waiting) > 0 && isClosed(waiting[0].done) {
+			pos = waiting[0].pos
+			waiting[0] = nil
+			waiting = waiting[1:]
+		}
+		if err := s.queue.Ack(pos); err != nil && err != ErrQueueClosed {
+			log.Printf("error acknowledging %v: %s", pos, err)
+		}
+	}
+}
+
+// isClosed returns whether the channel is closed
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// process stores the message and runs the matching rules, enqueueing
+// the deliveries to the destinations' workers; p (if not nil) is released
+// by each delivery when finished
+func (s *Server) process(m *Message, p *pendingAck) {
+	s.tail.Publish(m)
+	if s.store != nil {
+		s.store <- m
+	}
+	log.Printf("got %#v", m)
+	if LogLevel(m.Level) <= ERROR {
+		log.Printf("ERROR from %s@%s: %s\n%s", m.Facility, m.Host, m.Short, m.Full)
+	}
+	for _, rule := range s.currentRules() {
+		if rule.Match(m) {
+			log.Printf("rule %s matches %s", rule.Name, m)
+			for _, al := range rule.Then {
+				s.deliver(rule.Name, al, m, p)
 			}
 		}
 	}
@@ -6,22 +6,33 @@ package loglib
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/tgulacsi/go-xmlrpc"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type callFunc func(subject, body string) (int, error)
+// mantisTracker creates the issues with the XML-RPC new_issue call of Mantis
+type mantisTracker struct {
+	username, password string
+	client             *http.Client
+}
 
-type mantisSender struct {
-	callers map[string]callFunc
+// NewMantisTracker returns a Mantis IssueTracker, using the given credentials
+// for the URLs without embedded ones, with the given request timeout
+func NewMantisTracker(username, password string, timeout time.Duration) IssueTracker {
+	return mantisTracker{username: username, password: password,
+		client: newXMLRPCClient(timeout)}
 }
 
-// NewMantisSender returns a new Mantis sender
-func NewMantisSender() (ms *mantisSender) {
-	return &mantisSender{callers: make(map[string]callFunc, 4)}
+// newXMLRPCClient returns a client without gzip, with the given request timeout
+func newXMLRPCClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &http.Transport{DisableCompression: true},
+		Timeout: timeout}
 }
 
 // splits url, gets username/password and project and category
@@ -45,47 +56,104 @@ func splitURL(uri string) (mantisURL, projectName, category, username, password
 	return
 }
 
-// Send creates a new Mantis issue on the given uri
-func (ms *mantisSender) Send(uri, subject, body string) (int, error) {
-	if ms.callers == nil {
-		ms.callers = make(map[string]callFunc, 1)
+// NewIssue creates a new Mantis issue at issue.URL. The project, the category
+// and the credentials embedded in the URL are used if not given otherwise.
+func (mt mantisTracker) NewIssue(issue Issue) (string, error) {
+	_, projectName, category, _, _, err := splitURL(issue.URL)
+	if err != nil {
+		return "", err
 	}
-	call, ok := ms.callers[uri]
-	if !ok {
-		mantisURL, projectName, category, username, password, err := splitURL(uri)
-		if err != nil {
-			return -1, err
+	if issue.Project != "" {
+		projectName = issue.Project
+	}
+	if issue.Category != "" {
+		category = issue.Category
+	}
+	resp, err := mt.call(issue.URL, "new_issue", map[string]string{"project_name": projectName,
+		"summary": issue.Summary, "description": issue.Description, "category": category})
+	if err != nil {
+		return "", err
+	}
+	switch id := resp.(type) {
+	case int:
+		return strconv.Itoa(id), nil
+	case int64:
+		return strconv.FormatInt(id, 10), nil
+	case string:
+		if id != "" {
+			return id, nil
 		}
-		call = func(subject, body string) (int, error) {
-			args := map[string]string{"project_name": projectName, "summary": subject,
-				"description": body, "category": category}
-			log.Printf("calling %s new_issue(%v)", mantisURL, args)
-			resp, fault, err := Call(mantisURL, username, password, "new_issue", args)
-			log.Printf("got %v, %v, %s", resp, fault, err)
-			if err == nil {
-				log.Printf("response: %v", resp)
-				return -1, fault
-			}
-			return 0, err
+	}
+	return "", fmt.Errorf("unexpected new_issue response %#v (%T)", resp, resp)
+}
+
+// IsOpen returns whether the issue is neither resolved nor closed,
+// with the get_issue call
+func (mt mantisTracker) IsOpen(issue Issue, key string) (bool, error) {
+	resp, err := mt.call(issue.URL, "get_issue", map[string]string{"issue_id": key})
+	if err != nil {
+		// the fault of a deleted issue: treat it as closed
+		if _, ok := err.(*xmlrpc.Fault); ok && strings.Contains(err.Error(), "not exist") {
+			return false, nil
 		}
+		return false, err
+	}
+	fields, ok := resp.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("unexpected get_issue response %#v", resp)
+	}
+	status := fields["status"]
+	if st, ok := status.(map[string]interface{}); ok {
+		status = st["name"]
+	}
+	switch status {
+	case "resolved", "closed":
+		return false, nil
 	}
-	return call(subject, body)
+	return true, nil
+}
+
+// AddNote adds the note to the issue with the add_note call
+func (mt mantisTracker) AddNote(issue Issue, key, note string) error {
+	_, err := mt.call(issue.URL, "add_note", map[string]string{"issue_id": key, "text": note})
+	return err
+}
+
+// call calls the method of the Mantis XML-RPC interface at uri, with the
+// credentials embedded in the uri, or the tracker's
+func (mt mantisTracker) call(uri, method string, args map[string]string) (interface{}, error) {
+	mantisURL, _, _, username, password, err := splitURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	if username == "" {
+		username, password = mt.username, mt.password
+	}
+	resp, fault, err := callXMLRPC(mt.client, mantisURL, username, password, method, args)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil {
+		return nil, fault
+	}
+	return resp, nil
 }
 
 // Call is an xmlrpc.Call, but without gzip and Basic Auth and strips non-xml
 func Call(uri, username, password, name string, args ...interface{}) (
 	interface{}, *xmlrpc.Fault, error) {
+	return callXMLRPC(newXMLRPCClient(0), uri, username, password, name, args...)
+}
+
+// callXMLRPC is Call with the given client
+func callXMLRPC(client *http.Client, uri, username, password, name string, args ...interface{}) (
+	interface{}, *xmlrpc.Fault, error) {
 
 	buf := bytes.NewBuffer(nil)
 	e := xmlrpc.Marshal(buf, name, args...)
 	if e != nil {
 		return nil, nil, e
 	}
-	tr := &http.Transport{
-		//ClientConfig:    &tls.Config{RootCAs: pool},
-		DisableCompression: true,
-	}
-	client := &http.Client{Transport: tr}
 	req, e := http.NewRequest("POST", uri, buf)
 	if e != nil {
 		return nil, nil, e
@@ -104,7 +172,6 @@ func Call(uri, username, password, name string, args ...interface{}) (
 		return nil, nil, e
 	}
 	b := buf.Bytes()[:n]
-	log.Printf("got\n%s", b)
 	i := bytes.Index(b, []byte("<?"))
 	if i < 0 {
 		return nil, nil, io.EOF
@@ -0,0 +1,425 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// default URL of the PagerDuty Events API v2
+	defaultPagerURL = "https://events.pagerduty.com/v2/enqueue"
+	// default URL of the Opsgenie Alert API v2
+	defaultOpsgenieURL = "https://api.opsgenie.com/v2/alerts"
+)
+
+var (
+	// fields of the message the default deduplication key is derived from
+	defaultPagerDedup = []string{"facility", "host", "short"}
+	// fields of the message which must be the same in the recovery message
+	// for resolving an incident
+	defaultPagerResolveBy = []string{"facility", "host"}
+)
+
+// pagerAlert triggers incidents (PagerDuty Events API v2 trigger events, or
+// Opsgenie alerts with the dedup key as alias), and resolves (closes) the
+// open incidents when a message matches the Recovery filter.
+type pagerAlert struct {
+	// Kind is pagerduty or opsgenie
+	Kind string
+	URL  string
+	// RoutingKey is the PagerDuty routing key, or the Opsgenie API key
+	RoutingKey string
+	// Dedup are the fields of the deduplication key (besides the rule)
+	Dedup []string
+	// ResolveBy are the fields the recovery message must share with the incident's
+	ResolveBy []string
+	// Recovery is the name of the filter of the recovery messages
+	Recovery string
+	// recoveryRule is the name of the implicit rule of the Recovery filter
+	recoveryRule string
+
+	mu sync.Mutex
+	// incidents are the open incidents, in memory only if not set by the server
+	incidents *IncidentIndex
+}
+
+// IncidentIndex is the map of the open incidents (resolve-by values by
+// routing and dedup key), persisted in a JSON file if path is not empty
+type IncidentIndex struct {
+	path string
+	mu   sync.Mutex
+	open map[string][]string
+}
+
+// OpenIncidentIndex opens the incident index file (which need not exist)
+func OpenIncidentIndex(path string) (*IncidentIndex, error) {
+	ix := &IncidentIndex{path: path, open: make(map[string][]string)}
+	if err := readJSONFile(path, &ix.open); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// Put stores the open incident
+func (ix *IncidentIndex) Put(key string, vals []string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.open == nil {
+		ix.open = make(map[string][]string)
+	}
+	ix.open[key] = vals
+	return ix.save()
+}
+
+// Delete deletes the (resolved) incident
+func (ix *IncidentIndex) Delete(key string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if _, ok := ix.open[key]; !ok {
+		return nil
+	}
+	delete(ix.open, key)
+	return ix.save()
+}
+
+// Find returns the keys with the given prefix and resolve-by values
+func (ix *IncidentIndex) Find(prefix string, vals []string) []string {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	var keys []string
+	for k, v := range ix.open {
+		if strings.HasPrefix(k, prefix) && strings.Join(v, "\x00") == strings.Join(vals, "\x00") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ix *IncidentIndex) save() error {
+	if ix.path == "" {
+		return nil
+	}
+	return writeJSONFile(ix.path, ix.open)
+}
+
+// pagerEvent is an Events API v2 event
+type pagerEvent struct {
+	RoutingKey  string        `json:"routing_key"`
+	EventAction string        `json:"event_action"`
+	DedupKey    string        `json:"dedup_key"`
+	Payload     *pagerPayload `json:"payload,omitempty"`
+	Client      string        `json:"client,omitempty"`
+}
+
+type pagerPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp,omitempty"`
+	Component     string                 `json:"component,omitempty"`
+	Group         string                 `json:"group,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+// opsgenieAlert is an Opsgenie Alert API v2 alert
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Entity      string            `json:"entity,omitempty"`
+	Priority    string            `json:"priority"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// opsgenieClose is the body of the close request of an Opsgenie alert
+type opsgenieClose struct {
+	Source string `json:"source"`
+	Note   string `json:"note,omitempty"`
+}
+
+// pagerSeverity maps the level to an Events API v2 severity
+func pagerSeverity(level int32) string {
+	switch {
+	case level <= int32(CRITICAL):
+		return "critical"
+	case level == int32(ERROR):
+		return "error"
+	case level == int32(WARNING):
+		return "warning"
+	}
+	return "info"
+}
+
+// opsgeniePriority maps the level to an Opsgenie priority
+func opsgeniePriority(level int32) string {
+	switch {
+	case level <= int32(CRITICAL):
+		return "P1"
+	case level == int32(ERROR):
+		return "P2"
+	case level == int32(WARNING):
+		return "P3"
+	case level == int32(NOTICE):
+		return "P4"
+	}
+	return "P5"
+}
+
+// limitRunes returns s cut to at most n runes, ending with … if cut
+func limitRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// fieldValues returns the values of the fields of the message
+func fieldValues(m *Message, fields []string) []string {
+	vals := make([]string, len(fields))
+	for i, f := range fields {
+		vals[i], _ = textField(m, f)
+	}
+	return vals
+}
+
+// dedupKey returns the deduplication key of the message triggered by the rule
+func (a *pagerAlert) dedupKey(rule string, m *Message) string {
+	hsh := sha256.New()
+	for _, v := range fieldValues(m, a.Dedup) {
+		hsh.Write([]byte(v))
+		hsh.Write([]byte{0})
+	}
+	return rule + ":" + hex.EncodeToString(hsh.Sum(nil)[:10])
+}
+
+// Send triggers an incident for the message
+func (a *pagerAlert) Send(m *Message, s SenderProvider) error {
+	return a.SendRule("", m, s)
+}
+
+// SendRule triggers an incident for the message matched by the rule,
+// or resolves the matching open incidents for the implicit recovery rule.
+// The WebhookSender is retrieved from the SenderProvider.
+func (a *pagerAlert) SendRule(rule string, m *Message, s SenderProvider) error {
+	if a.recoveryRule != "" && rule == a.recoveryRule {
+		return a.resolve(m, s)
+	}
+	key := a.dedupKey(rule, m)
+	sender := s.GetWebhookSender(a.URL + "#" + key)
+	if sender == nil {
+		return nil
+	}
+	details := make(map[string]interface{}, len(m.Extra)+4)
+	for k, v := range m.Extra {
+		details[k] = v
+	}
+	details["level"] = levelName(m.Level)
+	if m.File != "" {
+		details["location"] = fmt.Sprintf("%s:%d", m.File, m.Line)
+	}
+	var err error
+	if a.Kind == "opsgenie" {
+		strs := make(map[string]string, len(details)+2)
+		for k, v := range details {
+			strs[k] = fmt.Sprintf("%v", v)
+		}
+		strs["facility"], strs["rule"] = m.Facility, rule
+		err = a.post(sender, a.URL, opsgenieAlert{Message: truncate(m.String(), 130),
+			Alias: key, Description: limitRunes(m.Full, 15000), Source: "woodchuck",
+			Entity: m.Host, Priority: opsgeniePriority(m.Level), Details: strs})
+	} else {
+		if m.Full != "" {
+			details["full"] = m.Full
+		}
+		var ts string
+		if m.TimeUnix > 0 {
+			ts = time.Unix(m.TimeUnix, 0).UTC().Format(time.RFC3339)
+		}
+		err = a.post(sender, a.URL, pagerEvent{RoutingKey: a.RoutingKey, EventAction: "trigger",
+			DedupKey: key, Client: "woodchuck",
+			Payload: &pagerPayload{Summary: limitRunes(m.String(), 1024), Source: m.Host,
+				Severity:  pagerSeverity(m.Level),
+				Timestamp: ts,
+				Component: m.Facility, Group: rule, CustomDetails: details}})
+	}
+	if err != nil {
+		return err
+	}
+	if a.Recovery != "" {
+		if err := a.index().Put(a.incidentKey(key), fieldValues(m, a.ResolveBy)); err != nil {
+			log.Printf("error storing incident %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// index returns the index of the open incidents
+func (a *pagerAlert) index() *IncidentIndex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.incidents == nil {
+		a.incidents = &IncidentIndex{}
+	}
+	return a.incidents
+}
+
+// incidentKey returns the key of the incident in the IncidentIndex:
+// the dedup key prefixed with the routing key
+func (a *pagerAlert) incidentKey(dedupKey string) string {
+	return a.RoutingKey + " " + dedupKey
+}
+
+// resolve sends resolve events (closes the alerts) for the open incidents
+// which have the same ResolveBy values as the recovery message
+func (a *pagerAlert) resolve(m *Message, s SenderProvider) error {
+	ix := a.index()
+	prefix := a.incidentKey("")
+	var errs []string
+	for _, k := range ix.Find(prefix, fieldValues(m, a.ResolveBy)) {
+		key := strings.TrimPrefix(k, prefix)
+		sender := s.GetWebhookSender(a.URL + "#resolve " + key)
+		if sender == nil {
+			continue
+		}
+		var err error
+		if a.Kind == "opsgenie" {
+			err = a.post(sender, a.URL+"/"+url.PathEscape(key)+"/close?identifierType=alias",
+				opsgenieClose{Source: "woodchuck", Note: "recovered: " + m.String()})
+		} else {
+			err = a.post(sender, a.URL, pagerEvent{RoutingKey: a.RoutingKey,
+				EventAction: "resolve", DedupKey: key})
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err := ix.Delete(k); err != nil {
+			log.Printf("error deleting incident %s: %s", key, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error resolving: %s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// post posts the event (or alert) as JSON to uri
+func (a *pagerAlert) post(sender WebhookSender, uri string, ev interface{}) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header, 3)
+	header.Set("Content-Type", "application/json")
+	header.Set("User-Agent", "woodchuck")
+	if a.Kind == "opsgenie" {
+		header.Set("Authorization", "GenieKey "+a.RoutingKey)
+	}
+	return sender.Send("POST", uri, header, body)
+}
+
+// buildPager builds the paging alerter of the destination from the
+// [destinations.NAME.pagerduty] or [destinations.NAME.opsgenie] table,
+// adding the errors to errs
+func buildPager(name, typ string, tree ConfigTree, errs *ConfigErrors) (*pagerAlert, bool) {
+	a := &pagerAlert{Kind: typ, URL: defaultPagerURL, Dedup: defaultPagerDedup,
+		ResolveBy: defaultPagerResolveBy}
+	keyName := "routing_key"
+	if typ == "opsgenie" {
+		a.URL, keyName = defaultOpsgenieURL, "api_key"
+	}
+	n := len(*errs)
+	str := func(k string) string {
+		s, ok := tree.Get(k).(string)
+		if !ok {
+			errs.Add(tree, k, "destination %s: %s %s must be a string", name, typ, k)
+		}
+		return s
+	}
+	list := func(k string) []string {
+		arr, err := getList(tree, k)
+		if err != nil {
+			errs.Add(tree, k, "destination %s: %s %s", name, typ, err)
+		} else if len(arr) == 0 {
+			errs.Add(tree, k, "destination %s: %s %s is empty", name, typ, k)
+		}
+		return arr
+	}
+	for _, k := range tree.Keys() {
+		switch k {
+		case "url":
+			a.URL = strings.TrimSuffix(str(k), "/")
+		case keyName:
+			a.RoutingKey = str(k)
+		case "dedup":
+			a.Dedup = list(k)
+		case "resolve_by":
+			a.ResolveBy = list(k)
+		case "recovery":
+			a.Recovery = str(k)
+		default:
+			errs.Add(tree, k, "destination %s: unsupported %s key %q", name, typ, k)
+		}
+	}
+	if a.RoutingKey == "" {
+		errs.Add(tree, keyName, "destination %s: %s needs a %s", name, typ, keyName)
+	}
+	if u, err := url.Parse(a.URL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.Add(tree, "url", "destination %s: %s needs an http(s) url, got %q", name, typ, a.URL)
+	}
+	return a, len(*errs) == n
+}
+
+// BuildRecoveryRules returns the implicit rules of the destinations' recovery
+// filters, which resolve the incidents opened by the destinations.
+// All the errors are returned, as ConfigErrors.
+func BuildRecoveryRules(tree ConfigTree, matchers map[string]Matcher, alerters map[string]Alerter) (rules []Rule, err error) {
+	tree = getSubtree(tree, "destinations")
+	var errs ConfigErrors
+	for _, k := range tree.Keys() {
+		a, ok := alerters[k].(*pagerAlert)
+		if !ok || a.Recovery == "" {
+			continue
+		}
+		mr, ok := matchers[a.Recovery]
+		if !ok {
+			errs.Add(getSubtree(getSubtree(tree, k), a.Kind), "recovery",
+				"destination %s: unknown recovery filter %q", k, a.Recovery)
+			continue
+		}
+		a.recoveryRule = "recovery of " + k
+		rules = append(rules, Rule{Name: a.recoveryRule, If: []Matcher{mr},
+			Then: []Alerter{Destination{Name: k, Alerter: a}}})
+	}
+	if err = errs.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// setIncidents sets the index of the open incidents of the paging alerters
+func setIncidents(alerters map[string]Alerter, ix *IncidentIndex) {
+	for _, al := range alerters {
+		if a, ok := al.(*pagerAlert); ok {
+			a.mu.Lock()
+			a.incidents = ix
+			a.mu.Unlock()
+		}
+	}
+}
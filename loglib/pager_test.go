@@ -0,0 +1,191 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+func TestPagerTriggerResolve(t *testing.T) {
+	var got []pagerEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev pagerEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decode event: %s", err)
+		}
+		got = append(got, ev)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	tree, err := toml.Load(`
+[filters.ok]
+short = "recovered"
+[destinations.pd.pagerduty]
+url = "` + srv.URL + `/v2/enqueue"
+routing_key = "rk"
+recovery = "ok"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func() *pagerAlert {
+		matchers, err := BuildMatchers(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alerters, err := BuildAlerters(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = BuildRecoveryRules(tree, matchers, alerters); err != nil {
+			t.Fatal(err)
+		}
+		return alerters["pd"].(*pagerAlert)
+	}
+	a := build()
+	path := filepath.Join(t.TempDir(), "incidents.json")
+	ix, err := OpenIncidentIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setIncidents(map[string]Alerter{"pd": a}, ix)
+
+	s := unlimitedSenders{&Server{webhook: NewWebhookSender(time.Second)}}
+	m := &Message{Host: "h", Facility: "f", Short: "boom", Level: int32(CRITICAL)}
+	for i := 0; i < 2; i++ {
+		if err = sendAlert(a, "boom", m, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d events, wanted 2", len(got))
+	}
+	key := a.dedupKey("boom", m)
+	for i, ev := range got {
+		if ev.EventAction != "trigger" || ev.RoutingKey != "rk" || ev.DedupKey != key {
+			t.Errorf("%d. got %s %s %s, wanted trigger rk %s", i, ev.EventAction, ev.RoutingKey, ev.DedupKey, key)
+		}
+		if ev.Payload == nil || ev.Payload.Severity != "critical" {
+			t.Errorf("%d. got payload %#v, wanted critical severity", i, ev.Payload)
+		}
+	}
+	if key[:5] != "boom:" {
+		t.Errorf("dedup key %q does not start with the rule", key)
+	}
+
+	// the open incident survives the restart
+	a = build()
+	if ix, err = OpenIncidentIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	setIncidents(map[string]Alerter{"pd": a}, ix)
+	got = got[:0]
+	other := &Message{Host: "other", Facility: "f", Short: "recovered", Level: int32(INFO)}
+	if err = sendAlert(a, a.recoveryRule, other, s); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("resolved %v for another host", got)
+	}
+	rec := &Message{Host: "h", Facility: "f", Short: "recovered", Level: int32(INFO)}
+	for i := 0; i < 2; i++ {
+		if err = sendAlert(a, a.recoveryRule, rec, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d events, wanted 1 resolve", len(got))
+	}
+	if ev := got[0]; ev.EventAction != "resolve" || ev.DedupKey != key || ev.Payload != nil {
+		t.Errorf("got %#v, wanted resolve of %s", ev, key)
+	}
+}
+
+func TestOpsgenieTriggerClose(t *testing.T) {
+	type request struct {
+		Path, Auth string
+		Body       map[string]interface{}
+	}
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{Path: r.URL.RequestURI(), Auth: r.Header.Get("Authorization")}
+		if err := json.NewDecoder(r.Body).Decode(&req.Body); err != nil {
+			t.Errorf("decode request: %s", err)
+		}
+		got = append(got, req)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	tree, err := toml.Load(`
+[filters.ok]
+short = "recovered"
+[destinations.og.opsgenie]
+url = "` + srv.URL + `/v2/alerts/"
+api_key = "ak"
+recovery = "ok"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchers, err := BuildMatchers(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerters, err := BuildAlerters(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = BuildRecoveryRules(tree, matchers, alerters); err != nil {
+		t.Fatal(err)
+	}
+	a := alerters["og"].(*pagerAlert)
+
+	s := unlimitedSenders{&Server{webhook: NewWebhookSender(time.Second)}}
+	m := &Message{Host: "h", Facility: "f", Short: "boom", Level: int32(ERROR)}
+	if err = sendAlert(a, "boom", m, s); err != nil {
+		t.Fatal(err)
+	}
+	rec := &Message{Host: "h", Facility: "f", Short: "recovered", Level: int32(INFO)}
+	for i := 0; i < 2; i++ {
+		if err = sendAlert(a, a.recoveryRule, rec, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, wanted create and close", len(got))
+	}
+	key := a.dedupKey("boom", m)
+	if r := got[0]; r.Path != "/v2/alerts" || r.Auth != "GenieKey ak" ||
+		r.Body["alias"] != key || r.Body["priority"] != "P2" || r.Body["entity"] != "h" {
+		t.Errorf("got %#v, wanted the creation of %s", r, key)
+	}
+	if r := got[1]; r.Path != "/v2/alerts/"+url.PathEscape(key)+"/close?identifierType=alias" ||
+		r.Auth != "GenieKey ak" {
+		t.Errorf("got %#v, wanted the close of %s", r, key)
+	}
+}
+
+func TestBuildOpsgenieErrors(t *testing.T) {
+	tree, err := toml.Load(`
+[destinations.og.opsgenie]
+routing_key = "rk"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = BuildAlerters(tree); err == nil {
+		t.Fatal("no error for a routing_key instead of api_key")
+	}
+}
@@ -0,0 +1,546 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQueueClosed is returned by DiskQueue.Get after Close
+var ErrQueueClosed = errors.New("queue closed")
+
+// ErrQueueDrained is returned by DiskQueue.Get after Drain, when the queue is empty
+var ErrQueueDrained = errors.New("queue drained")
+
+// fsync policies of the DiskQueue
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+// DiskQueueConfig is the configuration of the DiskQueue
+type DiskQueueConfig struct {
+	// SegmentSize is the size after a new segment file is started
+	SegmentSize int64
+	// MaxSize is the maximal size of all segments, the oldest are dropped above it
+	MaxSize int64
+	// MaxAge is the maximal age of a segment, older ones are dropped
+	MaxAge time.Duration
+	// Fsync is the fsync policy: always (after each write and ack),
+	// interval (every FsyncInterval) or never (leave it to the OS)
+	Fsync         string
+	FsyncInterval time.Duration
+}
+
+// QueuePos is a position in the DiskQueue: the segment and the offset in it
+type QueuePos struct {
+	Seg uint64
+	Off int64
+}
+
+type queueSeg struct {
+	id    uint64
+	size  int64
+	mtime time.Time
+}
+
+// DiskQueue is a write-ahead, segment-based, persistent message queue
+// with one consumer. Every record is a 4 byte length, a 4 byte CRC32 and
+// the JSON-encoded message. The consumer's acknowledged position is stored
+// in the cursor file, the messages after it are replayed after restart.
+type DiskQueue struct {
+	dir string
+	cfg DiskQueueConfig
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	segs []queueSeg
+	w    *os.File
+
+	r    *os.File
+	rbr  *bufio.Reader
+	rPos QueuePos
+
+	acked    QueuePos
+	ackDirty bool
+	closed   bool
+	draining bool
+	// lock is the exclusively locked lock file of the directory
+	lock *os.File
+}
+
+const (
+	queueSegSuffix   = ".seg"
+	queueCursorFile  = "cursor"
+	queueLockFile    = "lock"
+	queueHeaderSize  = 8
+	queueMaxRecordSz = 16 << 20
+)
+
+// OpenDiskQueue opens (or creates) the queue in the directory, locking it
+// exclusively: it fails if another process has the queue open
+func OpenDiskQueue(dir string, cfg DiskQueueConfig) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, queueLockFile))
+	if err != nil {
+		return nil, fmt.Errorf("queue %s is locked (used by another process?): %s", dir, err)
+	}
+	q, err := openDiskQueue(dir, cfg)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	q.lock = lock
+	return q, nil
+}
+
+// openDiskQueue opens the (already locked) queue in the directory
+func openDiskQueue(dir string, cfg DiskQueueConfig) (*DiskQueue, error) {
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 16 << 20
+	}
+	switch cfg.Fsync {
+	case "":
+		cfg.Fsync = FsyncInterval
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", cfg.Fsync)
+	}
+	if cfg.Fsync == FsyncInterval && cfg.FsyncInterval <= 0 {
+		cfg.FsyncInterval = time.Second
+	}
+	q := &DiskQueue{dir: dir, cfg: cfg}
+	q.cond = sync.NewCond(&q.mu)
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), queueSegSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), queueSegSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segs = append(q.segs, queueSeg{id: id, size: fi.Size(), mtime: fi.ModTime()})
+	}
+	sort.Slice(q.segs, func(i, j int) bool { return q.segs[i].id < q.segs[j].id })
+	if q.acked, err = q.readCursor(); err != nil {
+		return nil, err
+	}
+	// drop the already consumed segments
+	for len(q.segs) > 0 && q.segs[0].id < q.acked.Seg {
+		os.Remove(q.segPath(q.segs[0].id))
+		q.segs = q.segs[1:]
+	}
+	if len(q.segs) == 0 {
+		q.segs = append(q.segs, queueSeg{id: q.acked.Seg + 1, mtime: time.Now()})
+	} else if err = q.repairLast(); err != nil {
+		return nil, err
+	}
+	last := q.segs[len(q.segs)-1]
+	if q.w, err = os.OpenFile(q.segPath(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640); err != nil {
+		return nil, err
+	}
+	start := QueuePos{Seg: q.segs[0].id}
+	if q.acked.Seg == start.Seg {
+		start.Off = q.acked.Off
+	}
+	if err = q.openReader(start); err != nil {
+		q.w.Close()
+		return nil, err
+	}
+	if n := q.pending(); n > 0 {
+		log.Printf("queue %s: replaying %d bytes of unprocessed messages", dir, n)
+	}
+	go q.maintain()
+	return q, nil
+}
+
+func (q *DiskQueue) segPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016d%s", id, queueSegSuffix))
+}
+
+// readCursor reads the acknowledged position
+func (q *DiskQueue) readCursor() (QueuePos, error) {
+	var pos QueuePos
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, queueCursorFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pos, nil
+		}
+		return pos, err
+	}
+	if _, err = fmt.Sscanf(string(b), "%d %d", &pos.Seg, &pos.Off); err != nil {
+		return pos, fmt.Errorf("bad cursor file in %s: %s", q.dir, err)
+	}
+	return pos, nil
+}
+
+// writeCursor writes the acknowledged position atomically. Must be called with q.mu held.
+func (q *DiskQueue) writeCursor() error {
+	if !q.ackDirty {
+		return nil
+	}
+	fn := filepath.Join(q.dir, queueCursorFile)
+	fh, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(fh, "%d %d\n", q.acked.Seg, q.acked.Off)
+	if q.cfg.Fsync != FsyncNever {
+		fh.Sync()
+	}
+	if err = fh.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(fn+".tmp", fn); err != nil {
+		return err
+	}
+	q.ackDirty = false
+	return nil
+}
+
+// repairLast truncates the last segment after its last complete record,
+// as a crash could leave a partially written one
+func (q *DiskQueue) repairLast() error {
+	last := &q.segs[len(q.segs)-1]
+	fh, err := os.OpenFile(q.segPath(last.id), os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	br := bufio.NewReader(fh)
+	var off int64
+	for {
+		n, err := skipRecord(br)
+		if err != nil {
+			break
+		}
+		off += n
+	}
+	if off < last.size {
+		log.Printf("queue %s: truncating segment %d from %d to %d", q.dir, last.id, last.size, off)
+		if err = fh.Truncate(off); err != nil {
+			return err
+		}
+		last.size = off
+	}
+	return nil
+}
+
+// skipRecord reads and checks a record, returning its size
+func skipRecord(br *bufio.Reader) (int64, error) {
+	b, err := readRecord(br)
+	return int64(queueHeaderSize + len(b)), err
+}
+
+// readRecord reads a record and checks its CRC
+func readRecord(br *bufio.Reader) ([]byte, error) {
+	var head [queueHeaderSize]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:4])
+	if n > queueMaxRecordSz {
+		return nil, fmt.Errorf("record size %d too big", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(head[4:]) {
+		return nil, errors.New("CRC mismatch")
+	}
+	return b, nil
+}
+
+// openReader opens the segment of pos for reading, at pos.Off
+func (q *DiskQueue) openReader(pos QueuePos) error {
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+	fh, err := os.Open(q.segPath(pos.Seg))
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Seek(pos.Off, io.SeekStart); err != nil {
+		fh.Close()
+		return err
+	}
+	q.r, q.rPos = fh, pos
+	if q.rbr == nil {
+		q.rbr = bufio.NewReader(fh)
+	} else {
+		q.rbr.Reset(fh)
+	}
+	return nil
+}
+
+// pending returns the size of the unread records. Must be called with q.mu held.
+func (q *DiskQueue) pending() int64 {
+	var n int64
+	for _, seg := range q.segs {
+		if seg.id == q.rPos.Seg {
+			n += seg.size - q.rPos.Off
+		} else if seg.id > q.rPos.Seg {
+			n += seg.size
+		}
+	}
+	return n
+}
+
+// Put appends the message to the queue
+func (q *DiskQueue) Put(m *Message) error {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if len(b) > queueMaxRecordSz {
+		return fmt.Errorf("message too big (%d bytes)", len(b))
+	}
+	rec := make([]byte, queueHeaderSize+len(b))
+	binary.BigEndian.PutUint32(rec[:4], uint32(len(b)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(b))
+	copy(rec[queueHeaderSize:], b)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	last := &q.segs[len(q.segs)-1]
+	if last.size > 0 && last.size+int64(len(rec)) > q.cfg.SegmentSize {
+		if err = q.rotate(); err != nil {
+			return err
+		}
+		last = &q.segs[len(q.segs)-1]
+	}
+	if _, err = q.w.Write(rec); err != nil {
+		return err
+	}
+	if q.cfg.Fsync == FsyncAlways {
+		if err = q.w.Sync(); err != nil {
+			return err
+		}
+	}
+	last.size += int64(len(rec))
+	last.mtime = time.Now()
+	q.enforceLimits()
+	q.cond.Broadcast()
+	return nil
+}
+
+// rotate starts a new segment. Must be called with q.mu held.
+func (q *DiskQueue) rotate() error {
+	if q.cfg.Fsync != FsyncNever {
+		q.w.Sync()
+	}
+	q.w.Close()
+	id := q.segs[len(q.segs)-1].id + 1
+	w, err := os.OpenFile(q.segPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	q.w = w
+	q.segs = append(q.segs, queueSeg{id: id, mtime: time.Now()})
+	return nil
+}
+
+// enforceLimits drops the oldest segments above MaxSize or MaxAge,
+// even if they're unprocessed. Must be called with q.mu held.
+func (q *DiskQueue) enforceLimits() {
+	var total int64
+	for _, seg := range q.segs {
+		total += seg.size
+	}
+	for len(q.segs) > 1 {
+		seg := q.segs[0]
+		if !(q.cfg.MaxSize > 0 && total > q.cfg.MaxSize ||
+			q.cfg.MaxAge > 0 && time.Since(seg.mtime) > q.cfg.MaxAge) {
+			break
+		}
+		if q.rPos.Seg <= seg.id {
+			log.Printf("WARN queue %s: dropping segment %d with unprocessed messages", q.dir, seg.id)
+			if err := q.openReader(QueuePos{Seg: q.segs[1].id}); err != nil {
+				log.Printf("error opening segment %d: %s", q.segs[1].id, err)
+			}
+		}
+		if q.acked.Seg <= seg.id {
+			q.acked, q.ackDirty = QueuePos{Seg: q.segs[1].id}, true
+		}
+		os.Remove(q.segPath(seg.id))
+		total -= seg.size
+		q.segs = q.segs[1:]
+	}
+}
+
+// Get returns the next message and its position (to be acknowledged),
+// waiting for one if the queue is empty (and not draining)
+func (q *DiskQueue) Get() (*Message, QueuePos, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return nil, q.rPos, ErrQueueClosed
+		}
+		var seg *queueSeg
+		for i := range q.segs {
+			if q.segs[i].id == q.rPos.Seg {
+				seg = &q.segs[i]
+				break
+			}
+		}
+		if seg != nil && q.rPos.Off < seg.size {
+			b, err := readRecord(q.rbr)
+			if err != nil {
+				log.Printf("error reading queue segment %d at %d: %s; skipping the rest",
+					q.rPos.Seg, q.rPos.Off, err)
+				if err = q.openReader(QueuePos{Seg: seg.id, Off: seg.size}); err != nil {
+					return nil, q.rPos, err
+				}
+				continue
+			}
+			q.rPos.Off += int64(queueHeaderSize + len(b))
+			m := new(Message)
+			if err = m.UnmarshalJSON(b); err != nil {
+				log.Printf("error decoding queued message: %s", err)
+				continue
+			}
+			return m, q.rPos, nil
+		}
+		if next := q.nextSeg(q.rPos.Seg); next != 0 {
+			if err := q.openReader(QueuePos{Seg: next}); err != nil {
+				return nil, q.rPos, err
+			}
+			continue
+		}
+		if q.draining {
+			return nil, q.rPos, ErrQueueDrained
+		}
+		q.cond.Wait()
+	}
+}
+
+// Drain makes Get return ErrQueueDrained instead of waiting when the queue
+// is empty: to be called when there will be no more Put
+func (q *DiskQueue) Drain() {
+	q.mu.Lock()
+	q.draining = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// nextSeg returns the id of the segment after id, or 0
+func (q *DiskQueue) nextSeg(id uint64) uint64 {
+	for _, seg := range q.segs {
+		if seg.id > id {
+			return seg.id
+		}
+	}
+	return 0
+}
+
+// Ack acknowledges the processing of all the messages up to pos,
+// so they won't be replayed; the fully processed segments are deleted
+func (q *DiskQueue) Ack(pos QueuePos) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if pos.Seg < q.acked.Seg || pos.Seg == q.acked.Seg && pos.Off <= q.acked.Off {
+		return nil
+	}
+	q.acked, q.ackDirty = pos, true
+	for len(q.segs) > 1 && q.segs[0].id < pos.Seg {
+		os.Remove(q.segPath(q.segs[0].id))
+		q.segs = q.segs[1:]
+	}
+	if q.cfg.Fsync == FsyncAlways {
+		return q.writeCursor()
+	}
+	return nil
+}
+
+// Fill puts the messages from the channel into the queue, till it is closed
+func (q *DiskQueue) Fill(in <-chan *Message) {
+	for m := range in {
+		if err := q.Put(m); err != nil {
+			log.Printf("error queueing %s: %s", m, err)
+		}
+	}
+}
+
+// maintain syncs the queue and the cursor, and enforces the age limit
+// periodically
+func (q *DiskQueue) maintain() {
+	interval := q.cfg.FsyncInterval
+	if interval <= 0 || q.cfg.Fsync != FsyncInterval {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		if q.cfg.Fsync == FsyncInterval {
+			q.w.Sync()
+		}
+		if err := q.writeCursor(); err != nil {
+			log.Printf("error writing queue cursor: %s", err)
+		}
+		q.enforceLimits()
+		q.mu.Unlock()
+	}
+}
+
+// Close syncs and closes the queue
+func (q *DiskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	err := q.writeCursor()
+	if q.cfg.Fsync != FsyncNever {
+		q.w.Sync()
+	}
+	if e := q.w.Close(); e != nil && err == nil {
+		err = e
+	}
+	if q.r != nil {
+		q.r.Close()
+	}
+	if q.lock != nil {
+		q.lock.Close()
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"context"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Reload reloads the filters config file, and if it is valid, then swaps
+// the matchers, alerters and rules with the new ones; else keeps the old.
+// Changes in the transports config file are logged only, as they need restart.
+func (s *Server) Reload() error {
+	log.Printf("reloading %s", s.filtersFile)
+	matchers, alerters, rules, err := LoadFilters(s.filtersFile)
+	if err == nil {
+		err = s.checkTransports(alerters)
+	}
+	if err != nil {
+		log.Printf("error reloading %s, keeping the old configuration:\n%s", s.filtersFile, err)
+		return err
+	}
+	s.mu.Lock()
+	if s.incidents != nil {
+		// the open incidents survive the reload
+		setIncidents(alerters, s.incidents)
+	}
+	s.Matchers, s.Alerters, s.Rules = matchers, alerters, rules
+	s.mu.Unlock()
+	log.Printf("reloaded %s: %d filters, %d destinations, %d rules", s.filtersFile,
+		len(matchers), len(alerters), len(rules))
+
+	if changed, err := s.changedTransports(); err != nil {
+		log.Printf("error checking %s: %s", s.transportsFile, err)
+	} else {
+		for _, k := range changed {
+			log.Printf("WARN transport setting %s has changed in %s, needs restart", k, s.transportsFile)
+		}
+	}
+	return nil
+}
+
+// currentRules returns the actual rules
+func (s *Server) currentRules() []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Rules
+}
+
+// watchReload reloads the filters on SIGHUP, and on change of the file's
+// modification time, checking it in every interval (if positive),
+// till ctx is done
+func (s *Server) watchReload(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	var mtime time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		if fi, err := os.Stat(s.filtersFile); err == nil {
+			mtime = fi.ModTime()
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("got SIGHUP")
+		case <-tick:
+			fi, err := os.Stat(s.filtersFile)
+			if err != nil || fi.ModTime().Equal(mtime) {
+				continue
+			}
+			mtime = fi.ModTime()
+			log.Printf("%s has changed", s.filtersFile)
+		}
+		s.Reload()
+	}
+}
+
+// readTransports returns the flattened settings of the transports file
+func readTransports(transports string) (map[string]string, error) {
+	tree, err := toml.LoadFile(transports)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	var flatten func(prefix string, m map[string]interface{})
+	flatten = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]interface{}); ok {
+				flatten(prefix+k+".", sub)
+				continue
+			}
+			settings[prefix+k] = fmt.Sprintf("%v", v)
+		}
+	}
+	flatten("", tree.ToMap())
+	return settings, nil
+}
+
+// changedTransports returns the transport settings changed since start
+func (s *Server) changedTransports() ([]string, error) {
+	actual, err := readTransports(s.transportsFile)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for k, v := range actual {
+		if old, ok := s.transports[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range s.transports {
+		if _, ok := actual[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
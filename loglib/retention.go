@@ -0,0 +1,209 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metrics of the removed indices (or daily directories of the FileStore)
+var (
+	retentionIndices = expvar.NewInt("retention_deleted_indices")
+	retentionDocs    = expvar.NewInt("retention_deleted_docs")
+	retentionBytes   = expvar.NewInt("retention_deleted_bytes")
+)
+
+// Retention is the number of days the daily indices are kept:
+// Days for all, except the facilities with their own
+type Retention struct {
+	// Days is the global retention, 0 means forever
+	Days int
+	// Facilities are the retentions of the facilities which
+	// have their own indices, by the index name of the facility
+	Facilities map[string]int
+}
+
+// ParseRetention parses the facility:days,facility:days list
+func ParseRetention(days int, facilities string) (Retention, error) {
+	r := Retention{Days: days}
+	for _, part := range strings.Split(facilities, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.LastIndexByte(part, ':')
+		if i <= 0 {
+			return r, fmt.Errorf("bad facility retention %q (facility:days needed)", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+		if err != nil || n < 0 {
+			return r, fmt.Errorf("bad days in facility retention %q", part)
+		}
+		if r.Facilities == nil {
+			r.Facilities = make(map[string]int)
+		}
+		r.Facilities[indexFacility(part[:i])] = n
+	}
+	return r, nil
+}
+
+// indexFacility returns the facility as usable in an index name
+func indexFacility(facility string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '_':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, strings.TrimSpace(facility))
+}
+
+// IndexInfo is the name, size and day of a daily index
+type IndexInfo struct {
+	Name     string
+	Facility string
+	Day      time.Time
+	Docs     int64
+	Bytes    int64
+}
+
+// Indices returns the daily indices
+func (es *ElasticSearch) Indices() ([]IndexInfo, error) {
+	req, err := http.NewRequest("GET",
+		es.url("/_cat/indices/"+es.Index+"-*")+"?format=json&bytes=b&h=index,docs.count,store.size", nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := es.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var cat []struct {
+		Index string `json:"index"`
+		Docs  string `json:"docs.count"`
+		Size  string `json:"store.size"`
+	}
+	if err = json.Unmarshal(b, &cat); err != nil {
+		return nil, fmt.Errorf("error decoding indices: %s", err)
+	}
+	indices := make([]IndexInfo, 0, len(cat))
+	for _, c := range cat {
+		info, ok := es.parseIndexName(c.Index)
+		if !ok {
+			continue
+		}
+		info.Docs, _ = strconv.ParseInt(c.Docs, 10, 64)
+		info.Bytes, _ = strconv.ParseInt(c.Size, 10, 64)
+		indices = append(indices, info)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i].Name < indices[j].Name })
+	return indices, nil
+}
+
+// parseIndexName parses Index-YYYY.MM.DD and Index-facility-YYYY.MM.DD,
+// where facility must be as returned by indexFacility: other indices with
+// the same prefix are not touched. The facilities without their own retention
+// (e.g. removed from the facility retentions) are kept for the global one.
+func (es *ElasticSearch) parseIndexName(name string) (IndexInfo, bool) {
+	const dayLen = len("2006.01.02")
+	rest := strings.TrimPrefix(name, es.Index+"-")
+	if rest == name || len(rest) < dayLen {
+		return IndexInfo{}, false
+	}
+	day, err := time.Parse("2006.01.02", rest[len(rest)-dayLen:])
+	if err != nil {
+		return IndexInfo{}, false
+	}
+	info := IndexInfo{Name: name, Day: day}
+	if rest = rest[:len(rest)-dayLen]; rest != "" {
+		if !strings.HasSuffix(rest, "-") || len(rest) == 1 {
+			return IndexInfo{}, false
+		}
+		info.Facility = rest[:len(rest)-1]
+		if indexFacility(info.Facility) != info.Facility {
+			return IndexInfo{}, false
+		}
+	}
+	return info, true
+}
+
+// Expired returns whether the whole day of the index is older than its retention
+func (r Retention) Expired(info IndexInfo, now time.Time) bool {
+	days := r.Days
+	if info.Facility != "" {
+		if n, ok := r.Facilities[info.Facility]; ok {
+			days = n
+		}
+	}
+	if days <= 0 {
+		return false
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return info.Day.Before(today.AddDate(0, 0, -days))
+}
+
+// DropExpired deletes the daily indices expired by es.Retention, returning them.
+// With dryRun, it just returns what would be deleted.
+func (es *ElasticSearch) DropExpired(now time.Time, dryRun bool) ([]IndexInfo, error) {
+	indices, err := es.Indices()
+	if err != nil {
+		return nil, err
+	}
+	var dropped []IndexInfo
+	for _, info := range indices {
+		if !es.Retention.Expired(info, now) {
+			continue
+		}
+		if !dryRun {
+			req, err := http.NewRequest("DELETE", es.url("/"+info.Name), nil)
+			if err != nil {
+				return dropped, err
+			}
+			if _, err = es.do(req); err != nil {
+				return dropped, fmt.Errorf("error deleting %s: %s", info.Name, err)
+			}
+			retentionIndices.Add(1)
+			retentionDocs.Add(info.Docs)
+			retentionBytes.Add(info.Bytes)
+		}
+		dropped = append(dropped, info)
+	}
+	return dropped, nil
+}
+
+// retain drops the expired indices of the store at start and in every
+// interval, till ctx is done
+func retain(ctx context.Context, st Store, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		dropped, err := st.DropExpired(time.Now().UTC(), dryRun)
+		verb := "dropped"
+		if dryRun {
+			verb = "would drop"
+		}
+		for _, info := range dropped {
+			log.Printf("retention %s %s (%d docs, %d bytes)", verb, info.Name, info.Docs, info.Bytes)
+		}
+		if err != nil {
+			log.Printf("error dropping the expired indices: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchQuery is a query of the stored messages
+type SearchQuery struct {
+	// From and To limit the time range, if not zero
+	From, To time.Time
+	// Level is the least severe level searched (-1 for all)
+	Level LogLevel
+	Host  string
+	// Facility is the facility searched
+	Facility string
+	// Text is searched in the short and full messages
+	// (Elasticsearch simple query string syntax)
+	Text string
+	// Extra are the required values of the additional fields
+	Extra map[string]string
+	// Offset and Limit are for pagination
+	Offset, Limit int
+}
+
+// default and maximal number of messages returned by a search
+const (
+	searchDefaultLimit = 50
+	searchMaxLimit     = 1000
+)
+
+// SearchResult is the result of a search
+type SearchResult struct {
+	// Total is the number of all the matching messages
+	Total    int64      `json:"total"`
+	Messages []*Message `json:"messages"`
+}
+
+// ParseSearchQuery parses the query parameters:
+// from, to (RFC3339 time or duration before now, such as 1h),
+// level (number or name), host, facility, q (text), offset, limit, and
+// extra.NAME (or _NAME) for the additional fields.
+func ParseSearchQuery(params url.Values) (SearchQuery, error) {
+	q := SearchQuery{Level: -1, Host: params.Get("host"),
+		Facility: params.Get("facility"), Text: params.Get("q"), Limit: searchDefaultLimit}
+	now := time.Now()
+	var err error
+	if q.From, err = parseSearchTime(params.Get("from"), now); err != nil {
+		return q, fmt.Errorf("bad from: %s", err)
+	}
+	if q.To, err = parseSearchTime(params.Get("to"), now); err != nil {
+		return q, fmt.Errorf("bad to: %s", err)
+	}
+	if s := params.Get("level"); s != "" {
+		if q.Level, err = parseLevel(s); err != nil {
+			return q, err
+		}
+	}
+	for _, k := range []string{"offset", "limit"} {
+		s := params.Get(k)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("bad %s %q", k, s)
+		}
+		if k == "offset" {
+			q.Offset = n
+		} else {
+			q.Limit = n
+		}
+	}
+	if q.Limit == 0 {
+		q.Limit = searchDefaultLimit
+	} else if q.Limit > searchMaxLimit {
+		q.Limit = searchMaxLimit
+	}
+	for k, vs := range params {
+		var name string
+		if strings.HasPrefix(k, "extra.") {
+			name = k[6:]
+		} else if strings.HasPrefix(k, "_") {
+			name = k[1:]
+		}
+		if name == "" || len(vs) == 0 {
+			continue
+		}
+		if q.Extra == nil {
+			q.Extra = make(map[string]string)
+		}
+		q.Extra[name] = vs[0]
+	}
+	return q, nil
+}
+
+// parseSearchTime parses the RFC3339 time, or the duration before now
+func parseSearchTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseLevel parses the level number or name
+func parseLevel(s string) (LogLevel, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(LevelNames) {
+		return LogLevel(n), nil
+	}
+	for i, name := range LevelNames {
+		if strings.EqualFold(name, s) {
+			return LogLevel(i), nil
+		}
+	}
+	return -1, fmt.Errorf("bad level %q", s)
+}
+
+// esQuery returns the Elasticsearch query of the search
+func (q SearchQuery) esQuery() map[string]interface{} {
+	type M map[string]interface{}
+	var filter []interface{}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		rng := M{}
+		if !q.From.IsZero() {
+			rng["gte"] = q.From.UTC().Format(time.RFC3339)
+		}
+		if !q.To.IsZero() {
+			rng["lte"] = q.To.UTC().Format(time.RFC3339)
+		}
+		filter = append(filter, M{"range": M{"@timestamp": rng}})
+	}
+	if q.Level >= 0 {
+		filter = append(filter, M{"range": M{"level": M{"lte": int(q.Level)}}})
+	}
+	if q.Host != "" {
+		filter = append(filter, M{"term": M{"host": q.Host}})
+	}
+	if q.Facility != "" {
+		filter = append(filter, M{"term": M{"facility": q.Facility}})
+	}
+	for k, v := range q.Extra {
+		filter = append(filter, M{"term": M{"extra." + k: v}})
+	}
+	boolQ := M{"filter": filter}
+	if q.Text != "" {
+		boolQ["must"] = M{"simple_query_string": M{"query": q.Text,
+			"fields": []string{"short_message", "full_message"}, "default_operator": "and"}}
+	}
+	return M{"from": q.Offset, "size": q.Limit, "track_total_hits": true,
+		"sort":  []interface{}{M{"@timestamp": "desc"}},
+		"query": M{"bool": boolQ}}
+}
+
+// Search returns the stored messages matching the query, newest first
+func (es *ElasticSearch) Search(q SearchQuery) (*SearchResult, error) {
+	b, err := json.Marshal(q.esQuery())
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST",
+		es.url("/"+es.Index+"-*/_search")+"?ignore_unavailable=true&allow_no_indices=true",
+		bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b, err = es.do(req); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Hits struct {
+			Total struct {
+				Value int64 `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Source esDoc `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding search response: %s", err)
+	}
+	res := &SearchResult{Total: resp.Hits.Total.Value,
+		Messages: make([]*Message, len(resp.Hits.Hits))}
+	for i, hit := range resp.Hits.Hits {
+		res.Messages[i] = hit.Source.Message()
+	}
+	return res, nil
+}
+
+// Message returns the stored document as a Message
+func (doc esDoc) Message() *Message {
+	m := &Message{Version: doc.Version, Host: doc.Host, Short: doc.Short, Full: doc.Full,
+		Level: doc.Level, Facility: doc.Facility, File: doc.File, Line: doc.Line}
+	if t, err := time.Parse(time.RFC3339, doc.Timestamp); err == nil {
+		m.TimeUnix = t.Unix()
+	}
+	if len(doc.Extra) > 0 {
+		m.Extra = make(map[string]interface{}, len(doc.Extra))
+		for k, v := range doc.Extra {
+			m.Extra["_"+k] = v
+		}
+	}
+	return m
+}
+
+// SearchHandler returns the http.Handler of the search API: GET with the
+// ParseSearchQuery parameters, returning a JSON SearchResult
+func SearchHandler(st Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "GET needed!", http.StatusMethodNotAllowed)
+			return
+		}
+		q, err := ParseSearchQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := st.Search(q)
+		if err != nil {
+			log.Printf("error searching %v: %s", r.URL.Query(), err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(res)
+	})
+}
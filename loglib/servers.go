@@ -9,7 +9,11 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/SocialCodeInc/go-gelf/gelf"
 	"io"
@@ -20,22 +24,48 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // ListenGelfUDP listens on the given UDP port for possibly chunked GELF messages
-// put every complete message into the channel
-func ListenGelfUDP(port int, ch chan<- *Message) error {
+// put every complete message into the channel, till ctx is done
+func ListenGelfUDP(ctx context.Context, port int, ch chan<- *Message) error {
 	log.Printf("start listening on :%d", port)
 	r, err := gelf.NewReader(":" + strconv.Itoa(port))
 	if err != nil {
 		return err
 	}
-	var gm *gelf.Message
+	// the gelf.Reader cannot be closed, so read in a separate goroutine,
+	// which is left behind blocked in the read after ctx is done
+	gms, errc := make(chan *gelf.Message), make(chan error, 1)
+	go func() {
+		for {
+			gm, err := r.ReadMessage()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case gms <- gm:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 	for {
-		if gm, err = r.ReadMessage(); err != nil {
+		select {
+		case gm := <-gms:
+			m := AsMessage(gm)
+			// no TLS over UDP, so the subject can only be forged
+			SetPeerSubject(m, "")
+			ch <- m
+		case err = <-errc:
 			return fmt.Errorf("error reading message: %s", err)
+		case <-ctx.Done():
+			log.Printf("stop listening on :%d", port)
+			return nil
 		}
-		ch <- AsMessage(gm)
 	}
 }
 
@@ -44,102 +74,471 @@ var (
 	magicGzip = []byte{0x1f, 0x8b}
 )
 
-// ListenGelfTCP listen on the given TCP port for full, possibly compressed
-// GELF messages put every message into the channel
-func ListenGelfTCP(port int, ch chan<- *Message) error {
+// GelfTCPConfig is the configuration of the GELF TCP listener
+type GelfTCPConfig struct {
+	// Framing is "null" for \0-delimited frames, "newline" for \0 or \n
+	// delimited frames, "oneshot" for one (possibly compressed) message
+	// per connection
+	Framing string
+	// MaxSize is the maximal size of one frame
+	MaxSize int
+	// IdleTimeout is the time after an idle connection is closed
+	IdleTimeout time.Duration
+	// TLS is the TLS configuration, nil for plaintext
+	TLS *tls.Config
+}
+
+// ListenGelfTCP listen on the given TCP port for GELF messages, framed
+// as cfg says, and put every message into the channel, till ctx is done
+func ListenGelfTCP(ctx context.Context, port int, cfg GelfTCPConfig, ch chan<- *Message) error {
 	log.Printf("start listening on :%d", port)
 	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
 		return err
 	}
-	handle := func(r io.ReadCloser) {
-		gm := &gelf.Message{}
-		defer r.Close()
-		if err = UnboxGelf(r, gm); err != nil {
-			log.Printf("error unboxing %s: %s", r, err)
-			return
+	if cfg.TLS != nil {
+		ln = tls.NewListener(ln, cfg.TLS)
+	}
+	var handle func(net.Conn, string)
+	switch cfg.Framing {
+	case "oneshot":
+		handle = func(conn net.Conn, peer string) {
+			defer conn.Close()
+			gm := &gelf.Message{}
+			if cfg.IdleTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(cfg.IdleTimeout))
+			}
+			var r io.ReadCloser = conn
+			if cfg.MaxSize > 0 {
+				r = struct {
+					io.Reader
+					io.Closer
+				}{io.LimitReader(conn, int64(cfg.MaxSize)), conn}
+			}
+			if err := unboxGelf(r, gm, int64(cfg.MaxSize)); err != nil {
+				log.Printf("error unboxing from %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+			m := AsMessage(gm)
+			SetPeerSubject(m, peer)
+			ch <- m
 		}
-		ch <- AsMessage(gm)
+	case "", "null", "newline":
+		handle = func(conn net.Conn, peer string) {
+			defer conn.Close()
+			readGelfFrames(conn, cfg, peer, ch)
+		}
+	default:
+		ln.Close()
+		return fmt.Errorf("unknown GELF TCP framing %q", cfg.Framing)
 	}
-	var conn net.Conn
+	return serveConns(ctx, ln, func(conn net.Conn) {
+		peer, err := handshake(conn, cfg.IdleTimeout)
+		if err != nil {
+			log.Printf("error in TLS handshake with %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		handle(conn, peer)
+	})
+}
+
+// serveConns accepts the connections and handles each in its own goroutine,
+// till ctx is done; then closes the listener and the open connections,
+// and waits for the handlers to return
+func serveConns(ctx context.Context, ln net.Listener, handle func(net.Conn)) error {
+	var (
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{})
+		wg    sync.WaitGroup
+	)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		ln.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+	defer wg.Wait()
 	for {
-		if conn, err = ln.Accept(); err != nil {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("stop listening on %s", ln.Addr())
+				return nil
+			}
 			log.Printf("error accepting: %s", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		mu.Lock()
+		if ctx.Err() != nil {
+			mu.Unlock()
+			conn.Close()
+			continue
+		}
+		conns[conn] = struct{}{}
+		wg.Add(1)
+		mu.Unlock()
+		go func() {
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				wg.Done()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// handshake completes the TLS handshake (if conn is a TLS connection),
+// and returns the verified client certificate's subject
+func handshake(conn net.Conn, timeout time.Duration) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if timeout > 0 {
+		tc.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	return peerSubject(tc.ConnectionState()), nil
+}
+
+// peerSubject returns the subject of the verified client certificate
+func peerSubject(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.String()
+}
+
+// PeerSubjectKey is the Extra key of the verified TLS client certificate's subject
+const PeerSubjectKey = "_tls_client_subject"
+
+// SetPeerSubject sets the verified client certificate subject in the Extra,
+// or deletes it if the sender has put it there
+func SetPeerSubject(m *Message, subject string) {
+	if subject == "" {
+		if m.Extra != nil {
+			delete(m.Extra, PeerSubjectKey)
+		}
+		return
+	}
+	if m.Extra == nil {
+		m.Extra = make(map[string]interface{}, 1)
+	}
+	m.Extra[PeerSubjectKey] = subject
+}
+
+// NewTLSConfig returns a server TLS configuration with the given certificate
+// and key files, verifying the client certificates against the clientCA file
+// if given, requiring them if requireClientCert is true
+func NewTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading key pair %s, %s: %s", certFile, keyFile, err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA file %s: %s", clientCAFile, err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if requireClientCert {
+		if cfg.ClientCAs == nil {
+			return nil, errors.New("client certificate required, but no client CA given")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// readGelfFrames reads the delimited GELF frames from the connection
+// till EOF, idle timeout or a too big frame
+func readGelfFrames(conn net.Conn, cfg GelfTCPConfig, peer string, ch chan<- *Message) {
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = bufio.MaxScanTokenSize
+	}
+	delims := "\x00"
+	if cfg.Framing == "newline" {
+		delims = "\x00\n"
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, delims); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for {
+		if cfg.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(cfg.IdleTimeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
+		frame := bytes.TrimSpace(scanner.Bytes())
+		if len(frame) == 0 {
+			continue
+		}
+		gm := &gelf.Message{}
+		if err := json.Unmarshal(frame, gm); err != nil {
+			log.Printf("error decoding frame from %s: %s", conn.RemoteAddr(), err)
 			continue
 		}
-		go handle(conn)
+		m := AsMessage(gm)
+		SetPeerSubject(m, peer)
+		ch <- m
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("error reading from %s: %s", conn.RemoteAddr(), err)
 	}
 }
 
-// ListenGelfHTTP listens on the given HTTP port for multipart/form POST
-// requests such as
+// ListenGelfHTTP listens on the given HTTP port for POST requests.
+// JSON bodies (Content-Type: application/json or application/x-ndjson,
+// possibly gzip/zlib compressed) can hold one GELF message, a JSON array
+// of them, or newline-delimited messages, as Graylog's /gelf endpoint.
+// Other bodies are parsed as multipart/form requests such as
 // curl -v -F timestamp=$(date '+%s') -F short=abraka -F host=$(hostname) -F full=dabra -F facility=proba -F level=6 http://unowebprd:12203/
-func ListenGelfHTTP(port int, ch chan<- *Message) error {
-	var (
-		rb io.ReadCloser
-		b  []byte
-		e  error
-		ok bool
-	)
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		var gm *gelf.Message
-		ok = false
+// The response is a JSON HTTPResult.
+// If tlsConfig is not nil, then it listens for HTTPS.
+// The bodies are limited to maxSize bytes, both compressed and decompressed.
+// When ctx is done, the server is shut down gracefully.
+func ListenGelfHTTP(ctx context.Context, port int, maxSize int, tlsConfig *tls.Config, ch chan<- *Message) error {
+	s := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: GelfHTTPHandler(ch, int64(maxSize)),
+		TLSConfig: tlsConfig}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		// waits for the active requests to put their messages into ch
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Printf("error shutting down HTTP on port %d: %s", port, err)
+		}
+	}()
+	var err error
+	if tlsConfig != nil {
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		err = s.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return fmt.Errorf("error listening HTTP on port %d: %s", port, err)
+	}
+	<-stopped
+	log.Printf("stop listening HTTP on port %d", port)
+	return nil
+}
+
+// HTTPResult is the response of the GELF HTTP handler
+type HTTPResult struct {
+	Accepted int             `json:"accepted"`
+	Errors   []HTTPItemError `json:"errors,omitempty"`
+}
+
+// HTTPItemError is the error of the Index-th message of the request
+type HTTPItemError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// GelfHTTPHandler returns the http.Handler which parses the posted
+// GELF messages and puts them into the channel.
+// The bodies are limited to maxSize bytes (if positive), both compressed
+// and decompressed.
+func GelfHTTPHandler(ch chan<- *Message, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Body != nil {
 			defer r.Body.Close()
+			if maxSize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+			}
 		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		parsErr := func(err error) {
-			ok = false
-			w.WriteHeader(400)
-			w.Write([]byte(err.Error()))
-			w.Write([]byte{'\n'})
-		}
+		var (
+			res  HTTPResult
+			gms  []*gelf.Message
+			errs []error
+		)
 		if r.Method != "POST" && r.Method != "PUT" {
-			parsErr(fmt.Errorf("POST needed!"))
+			errs = []error{errors.New("POST needed!")}
+		} else if isJSONRequest(r) {
+			gms, errs = unboxGelfHTTP(r.Body, maxSize)
 		} else {
-			gm = &gelf.Message{}
-			rb = nil
-			s := r.FormValue("full")
-			if s != "" {
-				if rb, e = decompress(bytes.NewReader([]byte(s))); e != nil {
-					parsErr(fmt.Errorf("error decompressing full: %s", e))
-				}
+			gm := &gelf.Message{}
+			if err := parseForm(r, gm, maxSize); err != nil {
+				errs = []error{err}
+			} else if gm.Facility == "" {
+				errs = []error{errors.New("facility is missing")}
 			} else {
-				if mpf, _, e := r.FormFile("full"); e != nil {
-					parsErr(e)
-				} else {
-					if rb, e = decompress(mpf); e != nil {
-						parsErr(fmt.Errorf("error decompressing full file: %s", e))
-					}
-				}
+				gms = []*gelf.Message{gm}
+			}
+		}
+		var peer string
+		if r.TLS != nil {
+			peer = peerSubject(*r.TLS)
+		}
+		for i, err := range errs {
+			if err != nil {
+				res.Errors = append(res.Errors, HTTPItemError{Index: i, Error: err.Error()})
 			}
-			if rb != nil && e == nil {
-				b, e = ioutil.ReadAll(rb)
-				rb.Close()
-				if e != nil {
-					parsErr(fmt.Errorf("error reading full: %s", e))
-				} else {
-					gm.Full = string(b)
-				}
+		}
+		for _, gm := range gms {
+			if gm == nil {
+				continue
 			}
-			if e = parseValues(r.Form, gm); e != nil {
-				parsErr(e)
+			m := AsMessage(gm)
+			SetPeerSubject(m, peer)
+			ch <- m
+			res.Accepted++
+		}
+		code := 201
+		if len(res.Errors) > 0 && res.Accepted == 0 {
+			code = 400
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+// isJSONRequest returns whether the request's body is JSON
+func isJSONRequest(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	switch strings.TrimSpace(strings.ToLower(ct)) {
+	case "application/json", "application/x-ndjson", "application/x-json-stream",
+		"application/x-gelf":
+		return true
+	case "", "application/octet-stream":
+		// Graylog's convention is a POST to /gelf with (compressed) JSON
+		return strings.HasSuffix(r.URL.Path, "/gelf")
+	}
+	return false
+}
+
+// unboxGelfHTTP decodes the (possibly compressed) GELF JSON body, which can be
+// a single message, an array of messages or newline-delimited messages.
+// The returned slices have the same length: one message or error per item.
+func unboxGelfHTTP(body io.Reader, maxSize int64) ([]*gelf.Message, []error) {
+	rc, err := decompress(body)
+	if err != nil {
+		return nil, []error{err}
+	}
+	rc = limitReadCloser(rc, maxSize)
+	defer rc.Close()
+	br := bufio.NewReader(rc)
+	var (
+		gms  []*gelf.Message
+		errs []error
+		raws []json.RawMessage
+	)
+	add := func(raw []byte) {
+		gm := &gelf.Message{}
+		if err := json.Unmarshal(raw, gm); err != nil {
+			gms, errs = append(gms, nil), append(errs, err)
+			return
+		}
+		gms, errs = append(gms, gm), append(errs, nil)
+	}
+	dec := json.NewDecoder(br)
+	if first, err := firstNonSpace(br); err != nil {
+		return nil, []error{err}
+	} else if first == '[' {
+		if err = dec.Decode(&raws); err != nil {
+			return nil, []error{fmt.Errorf("error decoding JSON array: %s", err)}
+		}
+		for _, raw := range raws {
+			add(raw)
+		}
+		return gms, errs
+	}
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				break
 			}
-			ok = true
+			// the stream is unusable after a syntax error
+			gms, errs = append(gms, nil), append(errs, fmt.Errorf("error decoding JSON: %s", err))
+			break
 		}
-		if ok {
-			w.WriteHeader(201)
-			w.Write([]byte{})
-			if gm != nil && gm.Facility != "" {
-				ch <- AsMessage(gm)
+		add(raw)
+	}
+	return gms, errs
+}
+
+// firstNonSpace returns the first non-whitespace byte, without consuming it
+func firstNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return 0, errors.New("empty body")
 			}
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+		default:
+			return b[0], nil
 		}
-		return
 	}
-	s := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: http.HandlerFunc(handler)}
-	s.ListenAndServe()
-	log.Fatalf("end listening HTTP on port %d", port)
-	return nil
+}
+
+// parseForm parses the multipart/form request into the gelf Message,
+// limiting the decompressed full to maxSize bytes
+func parseForm(r *http.Request, gm *gelf.Message, maxSize int64) error {
+	var (
+		rb  io.ReadCloser
+		err error
+	)
+	if s := r.FormValue("full"); s != "" {
+		if rb, err = decompress(strings.NewReader(s)); err != nil {
+			return fmt.Errorf("error decompressing full: %s", err)
+		}
+	} else if mpf, _, err := r.FormFile("full"); err == nil {
+		defer mpf.Close()
+		if rb, err = decompress(mpf); err != nil {
+			return fmt.Errorf("error decompressing full file: %s", err)
+		}
+	} else if err != http.ErrMissingFile && err != http.ErrNotMultipart {
+		return err
+	}
+	if rb != nil {
+		b, err := ioutil.ReadAll(limitReadCloser(rb, maxSize))
+		rb.Close()
+		if err != nil {
+			return fmt.Errorf("error reading full: %s", err)
+		}
+		gm.Full = string(b)
+	}
+	return parseValues(r.Form, gm)
 }
 
 // parse values from url.Values into the gelf Message
@@ -200,20 +599,54 @@ func decompress(r io.Reader) (rc io.ReadCloser, err error) {
 		rc, err = gzip.NewReader(br)
 	} else if bytes.Equal(head[:len(magicZlib)], magicZlib) {
 		rc, err = zlib.NewReader(br)
-	} else {
-		log.Printf("WARN not compressed? %x", head)
 	}
 	return
 }
 
+// limitReadCloser returns a ReadCloser which returns an error after
+// reading more than n bytes (if n is positive)
+func limitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n <= 0 {
+		return rc
+	}
+	return &limitedReadCloser{ReadCloser: rc, max: n, left: n}
+}
+
+type limitedReadCloser struct {
+	io.ReadCloser
+	max, left int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// one more byte is read to tell whether it is above the limit
+		var b [1]byte
+		if n, err := l.ReadCloser.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("decompressed body is larger than %d bytes", l.max)
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
 // UnboxGelf unboxes a GELF message: decompress and decode from JSON
-func UnboxGelf(rc io.ReadCloser, m *gelf.Message) (err error) {
+func UnboxGelf(rc io.ReadCloser, m *gelf.Message) error {
+	return unboxGelf(rc, m, 0)
+}
+
+// unboxGelf is UnboxGelf, limiting the decompressed message to maxSize bytes
+func unboxGelf(rc io.ReadCloser, m *gelf.Message, maxSize int64) (err error) {
 	var r io.ReadCloser
 	if r, err = decompress(rc); err != nil {
 		rc.Close()
 		return
 	}
-	err = json.NewDecoder(r).Decode(m)
+	err = json.NewDecoder(limitReadCloser(r, maxSize)).Decode(m)
 	r.Close()
 	rc.Close()
 	return err
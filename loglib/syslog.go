@@ -0,0 +1,356 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyslogFacilityNames are the names of the syslog facilities, indexed by code
+var SyslogFacilityNames = [24]string{"kern", "user", "mail", "daemon",
+	"auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+
+// maximal size of one syslog message
+const syslogMaxSize = 64 << 10
+
+// ListenSyslogUDP listens on the given UDP port for RFC 5424 or RFC 3164
+// syslog messages, one message per datagram,
+// put every parsed message into the channel, till ctx is done
+func ListenSyslogUDP(ctx context.Context, port int, ch chan<- *Message) error {
+	log.Printf("start listening syslog on udp :%d", port)
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		conn.Close()
+	}()
+	var (
+		n    int
+		addr net.Addr
+		m    *Message
+	)
+	buf := make([]byte, syslogMaxSize)
+	for {
+		if n, addr, err = conn.ReadFrom(buf); err != nil {
+			if ctx.Err() != nil {
+				log.Printf("stop listening syslog on udp :%d", port)
+				return nil
+			}
+			return fmt.Errorf("error reading syslog message: %s", err)
+		}
+		if m, err = ParseSyslog(buf[:n]); err != nil {
+			log.Printf("error parsing syslog message from %s: %s", addr, err)
+			continue
+		}
+		fillSyslogHost(m, addr)
+		SetPeerSubject(m, "")
+		ch <- m
+	}
+}
+
+// ListenSyslogTCP listens on the given TCP port for RFC 5424 or RFC 3164
+// syslog messages, framed either by octet counting or by newlines (RFC 6587),
+// put every parsed message into the channel, till ctx is done.
+// A connection idle for idleTimeout (if positive) is closed.
+func ListenSyslogTCP(ctx context.Context, port int, idleTimeout time.Duration, ch chan<- *Message) error {
+	log.Printf("start listening syslog on tcp :%d", port)
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReaderSize(conn, 4096)
+		for {
+			if idleTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(idleTimeout))
+			}
+			frame, err := readSyslogFrame(br)
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("error reading syslog frame from %s: %s", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			if len(frame) == 0 {
+				continue
+			}
+			m, err := ParseSyslog(frame)
+			if err != nil {
+				log.Printf("error parsing syslog message from %s: %s", conn.RemoteAddr(), err)
+				continue
+			}
+			fillSyslogHost(m, conn.RemoteAddr())
+			SetPeerSubject(m, "")
+			ch <- m
+		}
+	}
+	return serveConns(ctx, ln, handle)
+}
+
+// readSyslogFrame reads one frame: if it starts with a digit, then it is
+// octet-counted ("LEN SP MSG"), else newline-terminated
+func readSyslogFrame(br *bufio.Reader) ([]byte, error) {
+	head, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if head[0] < '0' || head[0] > '9' {
+		var line []byte
+		for {
+			chunk, err := br.ReadSlice('\n')
+			if len(line)+len(chunk) > syslogMaxSize {
+				return nil, fmt.Errorf("line longer than %d bytes", syslogMaxSize)
+			}
+			line = append(line, chunk...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && !(err == io.EOF && len(line) > 0) {
+				return nil, err
+			}
+			break
+		}
+		return bytes.TrimRight(line, "\r\n\x00"), nil
+	}
+	s, err := br.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil {
+		return nil, fmt.Errorf("bad octet count %q: %s", s, err)
+	}
+	if n <= 0 || n > syslogMaxSize {
+		return nil, fmt.Errorf("octet count %d out of range", n)
+	}
+	frame := make([]byte, n)
+	if _, err = io.ReadFull(br, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// fillSyslogHost fills the host from the remote address if the message
+// does not contain it
+func fillSyslogHost(m *Message, addr net.Addr) {
+	if m.Host != "" || addr == nil {
+		return
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	m.Host = host
+}
+
+// ParseSyslog parses an RFC 5424 or RFC 3164 syslog message.
+// The severity of the PRI part becomes the Level, the APP-NAME (or TAG)
+// the Facility (if not present, the name of the syslog facility).
+// Structured data parameters go into Extra as "_"+SD-ID+"_"+name
+// (with the characters other than letters, digits, '_', '.' and '-' replaced by '_'),
+// MSGID, PROCID and the syslog facility as _msgid, _procid, _syslog_facility.
+func ParseSyslog(b []byte) (*Message, error) {
+	b = bytes.TrimRight(b, "\r\n\x00")
+	if len(b) < 3 || b[0] != '<' {
+		return nil, errors.New("missing PRI")
+	}
+	i := bytes.IndexByte(b, '>')
+	if i < 2 || i > 4 {
+		return nil, errors.New("bad PRI")
+	}
+	pri, err := strconv.Atoi(string(b[1:i]))
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, fmt.Errorf("bad PRI %q", b[1:i])
+	}
+	m := &Message{Level: int32(pri % 8),
+		Extra: map[string]interface{}{"_syslog_facility": SyslogFacilityNames[pri/8]}}
+	b = b[i+1:]
+	if len(b) > 1 && b[0] >= '1' && b[0] <= '9' && b[1] == ' ' {
+		err = parseRFC5424(b[2:], m)
+	} else {
+		err = parseRFC3164(b, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Facility == "" {
+		m.Facility = SyslogFacilityNames[pri/8]
+	}
+	if m.TimeUnix == 0 {
+		m.TimeUnix = time.Now().Unix()
+	}
+	return m, nil
+}
+
+// nextField returns the next space-separated field and the rest
+func nextField(b []byte) (string, []byte) {
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		return string(b[:i]), b[i+1:]
+	}
+	return string(b), nil
+}
+
+// parseRFC5424 parses the part after "<PRI>VERSION "
+func parseRFC5424(b []byte, m *Message) error {
+	var ts, host, app, procid, msgid string
+	ts, b = nextField(b)
+	host, b = nextField(b)
+	app, b = nextField(b)
+	procid, b = nextField(b)
+	msgid, b = nextField(b)
+	if ts != "-" {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return fmt.Errorf("bad timestamp %q: %s", ts, err)
+		}
+		m.TimeUnix = t.Unix()
+	}
+	if host != "-" {
+		m.Host = host
+	}
+	if app != "-" {
+		m.Facility = app
+	}
+	if procid != "-" && procid != "" {
+		m.Extra["_procid"] = procid
+	}
+	if msgid != "-" && msgid != "" {
+		m.Extra["_msgid"] = msgid
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var err error
+	if b[0] == '-' {
+		b = b[1:]
+	} else if b, err = parseStructuredData(b, m.Extra); err != nil {
+		return err
+	}
+	if len(b) > 0 && b[0] == ' ' {
+		b = b[1:]
+	}
+	setSyslogText(m, string(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))))
+	return nil
+}
+
+// parseStructuredData parses the [id name="value"...]... elements
+// into extra, returns the rest
+func parseStructuredData(b []byte, extra map[string]interface{}) ([]byte, error) {
+	for len(b) > 0 && b[0] == '[' {
+		b = b[1:]
+		i := bytes.IndexAny(b, " ]")
+		if i < 0 {
+			return nil, errors.New("unterminated structured data")
+		}
+		id := sdName(b[:i])
+		b = b[i:]
+		for len(b) > 0 && b[0] == ' ' {
+			b = b[1:]
+			j := bytes.IndexByte(b, '=')
+			if j < 1 || len(b) < j+2 || b[j+1] != '"' {
+				return nil, fmt.Errorf("bad structured data parameter at %q", b)
+			}
+			name := string(b[:j])
+			b = b[j+2:]
+			val := make([]byte, 0, 16)
+			for {
+				if len(b) == 0 {
+					return nil, fmt.Errorf("unterminated value of %s", name)
+				}
+				c := b[0]
+				b = b[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && len(b) > 0 && (b[0] == '"' || b[0] == '\\' || b[0] == ']') {
+					c = b[0]
+					b = b[1:]
+				}
+				val = append(val, c)
+			}
+			extra["_"+id+"_"+sdName([]byte(name))] = string(val)
+		}
+		if len(b) == 0 || b[0] != ']' {
+			return nil, errors.New("unterminated structured data element")
+		}
+		b = b[1:]
+	}
+	return b, nil
+}
+
+// sdName returns the SD-ID or PARAM-NAME usable in an additional field name
+func sdName(b []byte) string {
+	return string(bytes.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+			r == '_', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, b))
+}
+
+// parseRFC3164 parses the part after "<PRI>": "Mmm dd hh:mm:ss HOST TAG: MSG"
+func parseRFC3164(b []byte, m *Message) error {
+	const stampLen = len(time.Stamp)
+	if len(b) >= stampLen+1 && b[stampLen] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, string(b[:stampLen]), time.Local); err == nil {
+			now := time.Now()
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) { // December's message in January
+				t = t.AddDate(-1, 0, 0)
+			}
+			m.TimeUnix = t.Unix()
+			b = b[stampLen+1:]
+			m.Host, b = nextField(b)
+		}
+	}
+	// TAG is alphanumeric, at most 32 characters, terminated by [pid] or :
+	i := bytes.IndexAny(b, ":[ ")
+	if i > 0 && i <= 32 && (b[i] == ':' || b[i] == '[') {
+		m.Facility = string(b[:i])
+		b = b[i:]
+		if b[0] == '[' {
+			if j := bytes.IndexByte(b, ']'); j > 0 {
+				m.Extra["_procid"] = string(b[1:j])
+				b = b[j+1:]
+			}
+		}
+		b = bytes.TrimPrefix(b, []byte{':'})
+		b = bytes.TrimPrefix(b, []byte{' '})
+	}
+	setSyslogText(m, string(b))
+	return nil
+}
+
+// setSyslogText sets Short to the first line, Full to the whole text,
+// if it is multi-line
+func setSyslogText(m *Message, text string) {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		m.Short, m.Full = text[:i], text
+		return
+	}
+	m.Short = text
+}
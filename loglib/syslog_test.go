@@ -0,0 +1,128 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	for i, tc := range []struct {
+		in   string
+		want Message
+	}{
+		{`<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed`,
+			Message{Host: "mymachine.example.com", Facility: "su", Level: 2, TimeUnix: 1065910455,
+				Short: "'su root' failed",
+				Extra: map[string]interface{}{"_syslog_facility": "auth", "_msgid": "ID47"}}},
+		{`<165>1 2003-10-11T22:14:15.003Z h evntslog 42 - [ex@32473 iut="3" msg="say \"hi\" [a\] \\ b"][prio@32473 iut="high"] event`,
+			Message{Host: "h", Facility: "evntslog", Level: 5, TimeUnix: 1065910455, Short: "event",
+				Extra: map[string]interface{}{"_syslog_facility": "local4", "_procid": "42",
+					"_ex_32473_iut": "3", "_ex_32473_msg": `say "hi" [a] \ b`, "_prio_32473_iut": "high"}}},
+		// NILVALUE fields, BOM, multi-line message
+		{"<13>1 - - - - - - \xef\xbb\xbfline1\nline2",
+			Message{Facility: "user", Level: 5, Short: "line1", Full: "line1\nline2",
+				Extra: map[string]interface{}{"_syslog_facility": "user"}}},
+		{`<13>1 - - - - - -`,
+			Message{Facility: "user", Level: 5,
+				Extra: map[string]interface{}{"_syslog_facility": "user"}}},
+		{`<13>Feb  5 17:32:18 10.0.0.99 myapp[123]: Use the BFG!`,
+			Message{Host: "10.0.0.99", Facility: "myapp", Level: 5, Short: "Use the BFG!",
+				Extra: map[string]interface{}{"_syslog_facility": "user", "_procid": "123"}}},
+		{`<0>Oct 11 22:14:15 mymachine su: 'su root' failed`,
+			Message{Host: "mymachine", Facility: "su", Level: 0, Short: "'su root' failed",
+				Extra: map[string]interface{}{"_syslog_facility": "kern"}}},
+		// no timestamp nor tag
+		{`<13>hello world`,
+			Message{Facility: "user", Level: 5, Short: "hello world",
+				Extra: map[string]interface{}{"_syslog_facility": "user"}}},
+	} {
+		m, err := ParseSyslog([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%d. %s: %s", i, tc.in, err)
+			continue
+		}
+		if tc.want.TimeUnix == 0 {
+			if m.TimeUnix == 0 {
+				t.Errorf("%d. %s: no timestamp", i, tc.in)
+			}
+			m.TimeUnix = 0
+		}
+		if !reflect.DeepEqual(*m, tc.want) {
+			t.Errorf("%d. %s:\ngot  %#v,\nwanted %#v", i, tc.in, *m, tc.want)
+		}
+	}
+}
+
+func TestParseSyslogRFC3164Time(t *testing.T) {
+	now := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m, err := ParseSyslog([]byte("<13>" + now.Format(time.Stamp) + " h app: x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(m.TimeUnix, 0); !got.Equal(now) {
+		t.Errorf("got %s, wanted %s", got, now)
+	}
+}
+
+func TestParseSyslogErrors(t *testing.T) {
+	for i, in := range []string{
+		``, `13>x`, `<>x`, `<192>x`, `<x>x`,
+		`<13>1 yesterday h app - - - x`,
+		`<13>1 - h app - - [id a="b" x`,
+		`<13>1 - h app - - [id a=b] x`,
+		`<13>1 - h app - - [id a="b"`,
+	} {
+		if m, err := ParseSyslog([]byte(in)); err == nil {
+			t.Errorf("%d. %q: no error, got %#v", i, in, m)
+		}
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	for i, tc := range []struct {
+		in   string
+		want []string
+	}{
+		// newline framing
+		{"<13>a b\n<13>c\r\n\n<13>last", []string{"<13>a b", "<13>c", "", "<13>last"}},
+		// octet counting, the frames can contain newlines
+		{"7 <13>a b13 <13>c\nd\n<13>e\n", []string{"<13>a b", "<13>c\nd\n<13>e", ""}},
+		// mixed
+		{"5 <13>a<13>b\n", []string{"<13>a", "<13>b"}},
+	} {
+		br := bufio.NewReader(strings.NewReader(tc.in))
+		var got []string
+		for {
+			frame, err := readSyslogFrame(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("%d. %q: %s", i, tc.in, err)
+				break
+			}
+			got = append(got, string(frame))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%d. %q: got %q, wanted %q", i, tc.in, got, tc.want)
+		}
+	}
+
+	for i, in := range []string{
+		"0 x", "99999999 x", "5x <13>a", "10 <13>a",
+		strings.Repeat("x", syslogMaxSize+1) + "\n",
+	} {
+		br := bufio.NewReader(strings.NewReader(in))
+		if _, err := readSyslogFrame(br); err == nil || err == io.EOF {
+			t.Errorf("%d. %.20q: got %v, wanted an error", i, in, err)
+		}
+	}
+}
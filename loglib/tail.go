@@ -0,0 +1,190 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tailBufferLen is the number of messages buffered per tail subscriber
+const tailBufferLen = 256
+
+// tailHub distributes the processed messages to the tail subscribers
+type tailHub struct {
+	mu   sync.RWMutex
+	subs map[*tailSub]struct{}
+}
+
+// tailSub is a tail subscriber
+type tailSub struct {
+	// dropped is first for the 64-bit alignment of the atomic access
+	dropped uint64
+	matcher Matcher
+	ch      chan *Message
+}
+
+// Subscribe returns a new subscriber for the messages matching m (all if nil)
+func (h *tailHub) Subscribe(m Matcher) *tailSub {
+	sub := &tailSub{matcher: m, ch: make(chan *Message, tailBufferLen)}
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[*tailSub]struct{})
+	}
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe removes the subscriber
+func (h *tailHub) Unsubscribe(sub *tailSub) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// Publish sends the message to the matching subscribers, without blocking:
+// if a subscriber's buffer is full, the message is dropped for it
+func (h *tailHub) Publish(m *Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		if sub.matcher != nil && !sub.matcher.Match(m) {
+			continue
+		}
+		select {
+		case sub.ch <- m:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// tailMatcher returns the Matcher of the tail request: the named filter
+// and/or the filter expression, nil for all messages
+func (s *Server) tailMatcher(params url.Values) (Matcher, error) {
+	var ms []Matcher
+	if name := params.Get("filter"); name != "" {
+		s.mu.RLock()
+		m, ok := s.Matchers[name]
+		s.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown filter %q", name)
+		}
+		ms = append(ms, m)
+	}
+	if src := params.Get("expr"); src != "" {
+		m, err := CompileExpr(src)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	switch len(ms) {
+	case 0:
+		return nil, nil
+	case 1:
+		return ms[0], nil
+	}
+	return allFilter(ms), nil
+}
+
+// TailHandler returns the http.Handler of the live tail: streams the
+// processed messages matching the filter=NAME and/or expr=EXPRESSION
+// parameters as Server-Sent Events, with "data: GELF JSON" events and
+// "dropped" events with the number of messages dropped since the last one
+func (s *Server) TailHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matcher, err := s.tailMatcher(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		sub := s.tail.Subscribe(matcher)
+		defer s.tail.Unsubscribe(sub)
+		log.Printf("tail subscriber %s connected (%s)", r.RemoteAddr, r.URL.RawQuery)
+		defer log.Printf("tail subscriber %s disconnected", r.RemoteAddr)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			case m := <-sub.ch:
+				if n := atomic.SwapUint64(&sub.dropped, 0); n > 0 {
+					fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", n)
+				}
+				var b []byte
+				if b, err = m.MarshalJSON(); err != nil {
+					log.Printf("error encoding %s: %s", m, err)
+					continue
+				}
+				_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// Tail streams the messages matching the named filter and/or the expression
+// to fun, till an error happens; dropped is called with the number of
+// the messages dropped because of the slow reading
+func (c *AdminClient) Tail(params url.Values, fun func(*Message), dropped func(uint64)) error {
+	resp, err := c.get("/tail", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 4096), 16<<20)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			event = ""
+		case bytes.HasPrefix(line, []byte("event: ")):
+			event = string(line[7:])
+		case bytes.HasPrefix(line, []byte("data: ")):
+			data := line[6:]
+			if event == "dropped" {
+				var n uint64
+				fmt.Sscan(string(data), &n)
+				if dropped != nil {
+					dropped(n)
+				}
+				continue
+			}
+			m := new(Message)
+			if err = m.UnmarshalJSON(data); err != nil {
+				return fmt.Errorf("error decoding %q: %s", data, err)
+			}
+			fun(m)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,241 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// RuleAlerter is an Alerter which uses the name of the rule it is sent for
+type RuleAlerter interface {
+	Alerter
+	SendRule(rule string, m *Message, s SenderProvider) error
+}
+
+// sendAlert sends the message with the alerter, passing the rule's name
+// if the alerter (of the destination) is a RuleAlerter
+func sendAlert(al Alerter, rule string, m *Message, s SenderProvider) error {
+	if d, ok := al.(Destination); ok {
+		al = d.Alerter
+	}
+	if ra, ok := al.(RuleAlerter); ok {
+		return ra.SendRule(rule, m, s)
+	}
+	return al.Send(m, s)
+}
+
+// webhookSender sends the webhook requests with an HTTP client
+type webhookSender struct {
+	client *http.Client
+}
+
+// NewWebhookSender returns a WebhookSender with the given request timeout
+func NewWebhookSender(timeout time.Duration) WebhookSender {
+	return webhookSender{client: &http.Client{Timeout: timeout}}
+}
+
+// Send sends the request, returning an error for non-2xx responses
+func (ws webhookSender) Send(method, uri string, header http.Header, body []byte) error {
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, redactURL(uri), resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// redactURL returns the URL without the password and the query
+func redactURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "?"
+	}
+	u.User, u.RawQuery = nil, ""
+	return u.String()
+}
+
+// WebhookData is the data of the webhook body template
+type WebhookData struct {
+	Rule    string
+	Message *Message
+	// Level is the name of the message's level
+	Level string
+	// Time is the message's timestamp
+	Time time.Time
+}
+
+// webhookFuncs are the functions of the body templates
+var webhookFuncs = template.FuncMap{
+	// json returns the JSON encoding of the value
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// defaultWebhookBody is the body template, if not configured: the message as GELF JSON
+const defaultWebhookBody = `{{json .Message}}`
+
+// default header of the HMAC-SHA256 signature of the body
+const defaultSignatureHeader = "X-Woodchuck-Signature"
+
+type webhookAlert struct {
+	URL             string
+	Method          string
+	Header          http.Header
+	Secret          string
+	SignatureHeader string
+	Body            *template.Template
+}
+
+// Send sends the message to the webhook
+func (a webhookAlert) Send(m *Message, s SenderProvider) error {
+	return a.SendRule("", m, s)
+}
+
+// SendRule renders the body from the message and the rule name, and sends it
+// (signed, if a secret is given), retrieving the WebhookSender from the SenderProvider
+func (a webhookAlert) SendRule(rule string, m *Message, s SenderProvider) error {
+	sender := s.GetWebhookSender(a.URL + "#" + m.String())
+	if sender == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := a.Body.Execute(&buf, WebhookData{Rule: rule, Message: m, Level: levelName(m.Level),
+		Time: time.Unix(m.TimeUnix, 0)}); err != nil {
+		return fmt.Errorf("error rendering webhook body: %s", err)
+	}
+	header := make(http.Header, len(a.Header)+2)
+	for k, vs := range a.Header {
+		header[k] = vs
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+	if header.Get("User-Agent") == "" {
+		header.Set("User-Agent", "woodchuck")
+	}
+	if a.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(a.Secret))
+		mac.Write(buf.Bytes())
+		header.Set(a.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return sender.Send(a.Method, a.URL, header, buf.Bytes())
+}
+
+// buildWebhook builds the webhook alerter of the destination from the
+// [destinations.NAME.webhook] table, adding the errors to errs
+func buildWebhook(name string, tree ConfigTree, errs *ConfigErrors) (webhookAlert, bool) {
+	a := webhookAlert{Method: "POST", SignatureHeader: defaultSignatureHeader,
+		Header: make(http.Header)}
+	n := len(*errs)
+	str := func(k string) string {
+		v := tree.Get(k)
+		if v == nil {
+			return ""
+		}
+		s, ok := v.(string)
+		if !ok {
+			errs.Add(tree, k, "destination %s: webhook %s must be a string", name, k)
+		}
+		return s
+	}
+	body := defaultWebhookBody
+	for _, k := range tree.Keys() {
+		switch k {
+		case "url":
+			a.URL = str(k)
+		case "method":
+			a.Method = strings.ToUpper(str(k))
+		case "secret":
+			a.Secret = str(k)
+		case "signature_header":
+			a.SignatureHeader = str(k)
+		case "body":
+			body = str(k)
+		case "headers":
+			sub, ok := tree.Get(k).(ConfigTree)
+			if !ok {
+				errs.Add(tree, k, "destination %s: webhook headers must be a table", name)
+				continue
+			}
+			for _, h := range sub.Keys() {
+				v, ok := sub.Get(h).(string)
+				if !ok {
+					errs.Add(sub, h, "destination %s: webhook header %s must be a string", name, h)
+					continue
+				}
+				a.Header.Add(h, v)
+			}
+		default:
+			errs.Add(tree, k, "destination %s: unsupported webhook key %q", name, k)
+		}
+	}
+	if u, err := url.Parse(a.URL); a.URL == "" || err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.Add(tree, "url", "destination %s: webhook needs an http(s) url, got %q", name, a.URL)
+	}
+	switch a.Method {
+	case "POST", "PUT", "PATCH":
+	default:
+		errs.Add(tree, "method", "destination %s: unsupported webhook method %q", name, a.Method)
+	}
+	var err error
+	if a.Body, err = template.New(name).Funcs(webhookFuncs).Parse(body); err != nil {
+		errs.Add(tree, "body", "destination %s: bad webhook body template: %s", name, err)
+	}
+	return a, len(*errs) == n
+}
+
+// breakerWebhookSender has a circuit breaker per webhook host
+type breakerWebhookSender struct {
+	WebhookSender
+	newBreaker func(name string) *CircuitBreaker
+	mu         sync.Mutex
+	breakers   map[string]*CircuitBreaker
+}
+
+// Send sends the request through the circuit breaker of the uri's host
+func (bs *breakerWebhookSender) Send(method, uri string, header http.Header, body []byte) error {
+	name := "webhook"
+	if u, err := url.Parse(uri); err == nil {
+		name += " " + u.Host
+	}
+	bs.mu.Lock()
+	cb, ok := bs.breakers[name]
+	if !ok {
+		if bs.breakers == nil {
+			bs.breakers = make(map[string]*CircuitBreaker, 2)
+		}
+		cb = bs.newBreaker(name)
+		bs.breakers[name] = cb
+	}
+	bs.mu.Unlock()
+	return cb.Do(func() error { return bs.WebhookSender.Send(method, uri, header, body) })
+}
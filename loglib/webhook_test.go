@@ -0,0 +1,87 @@
+// Copyright 2013 Tamás Gulácsi. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package loglib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+func TestWebhookSend(t *testing.T) {
+	type request struct {
+		method, path string
+		header       http.Header
+		body         string
+	}
+	var got []request
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = append(got, request{r.Method, r.URL.Path, r.Header, string(b)})
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	tree, err := toml.Load(`
+[destinations.bot.webhook]
+url = "` + srv.URL + `/hook"
+method = "put"
+secret = "s3cret"
+body = '{"text": {{json (printf "[%s] %s: %s" .Level .Rule .Message.Short)}}, "host": {{json .Message.Host}}}'
+[destinations.bot.webhook.headers]
+X-Token = "abc"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerters, err := BuildAlerters(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{webhook: NewWebhookSender(time.Second)}
+	m := &Message{Host: "h", Short: `he said "hi"`, Level: int32(ERROR)}
+	if err = sendAlert(Destination{Name: "bot", Alerter: alerters["bot"]}, "myrule", m,
+		unlimitedSenders{s}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d requests, wanted 1", len(got))
+	}
+	req := got[0]
+	if req.method != "PUT" || req.path != "/hook" {
+		t.Errorf("got %s %s, wanted PUT /hook", req.method, req.path)
+	}
+	if want := `{"text": "[ERROR] myrule: he said \"hi\"", "host": "h"}`; req.body != want {
+		t.Errorf("got body %s, wanted %s", req.body, want)
+	}
+	for k, want := range map[string]string{
+		"X-Token":      "abc",
+		"Content-Type": "application/json",
+		"User-Agent":   "woodchuck",
+	} {
+		if v := req.header.Get(k); v != want {
+			t.Errorf("got %s=%q, wanted %q", k, v, want)
+		}
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(req.body))
+	if sig, want := req.header.Get(defaultSignatureHeader),
+		"sha256="+hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(sig), []byte(want)) {
+		t.Errorf("got signature %q, wanted %q", sig, want)
+	}
+
+	status = http.StatusBadGateway
+	if err = sendAlert(alerters["bot"], "myrule", m, unlimitedSenders{s}); err == nil {
+		t.Errorf("no error for status %d", status)
+	}
+}
@@ -5,14 +5,295 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"github.com/tgulacsi/woodchuck/loglib"
 	"log"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	flagConfig  = flag.String("config", "config.toml", "transports config file")
+	flagFilters = flag.String("filters", "filters.toml", "filters config file")
+	flagDryRun  = flag.Bool("dry-run", false, "retention: just print what would be deleted")
 )
 
 func main() {
-	s, err := loglib.LoadConfig("config.toml", "filters.toml")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [flags] [command]
+
+Commands:
+  serve                                  start the server (default)
+  check                                  check the config files
+  deadletter list                        list the failed deliveries
+  deadletter show ID...                  show the failed deliveries
+  deadletter replay all|ID...            resend the failed deliveries
+  deadletter purge all|ID...             delete the failed deliveries
+  retention                              drop the expired days of the store
+  search [search flags] [text...]        search the stored messages
+                                         (see search -h)
+  tail [-filter NAME] [expression...]    watch the processed messages live
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "", "serve":
+		s, err := loglib.LoadConfig(*flagConfig, *flagFilters)
+		if err != nil {
+			log.Fatalf("error loading config: %s", err)
+		}
+		s.Serve()
+	case "check":
+		if err := loglib.CheckConfig(*flagConfig, *flagFilters); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s and %s are OK\n", *flagConfig, *flagFilters)
+	case "deadletter":
+		var ids []string
+		if flag.NArg() > 2 {
+			ids = flag.Args()[2:]
+		}
+		if err := deadLetter(flag.Arg(1), ids); err != nil {
+			log.Fatal(err)
+		}
+	case "search":
+		if err := search(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "tail":
+		if err := tail(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "retention":
+		if err := retention(*flagDryRun); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func retention(dryRun bool) error {
+	s, err := loglib.ParseConfig(*flagConfig, *flagFilters)
+	if err != nil {
+		return fmt.Errorf("error loading config: %s", err)
+	}
+	if err = s.OpenStore(); err != nil {
+		return err
+	}
+	if s.Store == nil {
+		return fmt.Errorf("no store in %s", *flagConfig)
+	}
+	dropped, err := s.Store.DropExpired(time.Now().UTC(), dryRun)
+	verb := "dropped"
+	if dryRun {
+		verb = "would drop"
+	}
+	var docs, size int64
+	for _, info := range dropped {
+		fmt.Printf("%s %s\t%d docs\t%d bytes\n", verb, info.Name, info.Docs, info.Bytes)
+		docs += info.Docs
+		size += info.Bytes
+	}
+	fmt.Printf("%s %d indices, %d docs, %d bytes\n", verb, len(dropped), docs, size)
+	return err
+}
+
+func deadLetter(verb string, ids []string) error {
+	// just the senders and the dead letters: the queue, the store and the
+	// issue index belong to the running server
+	s, err := loglib.ParseConfig(*flagConfig, *flagFilters)
+	if err != nil {
+		return fmt.Errorf("error loading config: %s", err)
+	}
+	if err = s.OpenDeadLetters(); err != nil {
+		return err
+	}
+	dls := s.DeadLetters
+	if dls == nil {
+		return fmt.Errorf("no delivery.deadletter_dir in %s", *flagConfig)
+	}
+	if verb != "list" && len(ids) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(ids) == 1 && ids[0] == "all" && (verb == "replay" || verb == "purge") {
+		if ids, err = dls.List(); err != nil {
+			return err
+		}
+	}
+	var failed int
+	switch verb {
+	case "list":
+		if ids, err = dls.List(); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 4, 8, 1, ' ', 0)
+		fmt.Fprintf(tw, "ID\tATTEMPTS\tRULE\tDESTINATION\tMESSAGE\tLAST ERROR\n")
+		for _, id := range ids {
+			dl, err := dls.Get(id)
+			if err != nil {
+				log.Printf("%s: %s", id, err)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", id, len(dl.Attempts),
+				dl.Rule, dl.Destination, dl.Message, dl.LastError())
+		}
+		return tw.Flush()
+	case "show":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		for _, id := range ids {
+			dl, err := dls.Get(id)
+			if err != nil {
+				return err
+			}
+			if err = enc.Encode(dl); err != nil {
+				return err
+			}
+		}
+	case "replay":
+		for _, id := range ids {
+			if err = s.Replay(dls, id); err != nil {
+				log.Printf("error replaying %s", err)
+				failed++
+				continue
+			}
+			fmt.Printf("replayed %s\n", id)
+		}
+	case "purge":
+		for _, id := range ids {
+			if err = dls.Delete(id); err != nil {
+				log.Printf("error deleting %s: %s", id, err)
+				failed++
+				continue
+			}
+			fmt.Printf("purged %s\n", id)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d failed", failed, len(ids))
+	}
+	return nil
+}
+
+// extraFlag collects the name=value additional field conditions
+type extraFlag url.Values
+
+func (f extraFlag) String() string { return "" }
+
+func (f extraFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("name=value needed, got %q", s)
+	}
+	url.Values(f).Set("extra."+strings.TrimPrefix(s[:i], "_"), s[i+1:])
+	return nil
+}
+
+func search(args []string) error {
+	params := make(url.Values)
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	fs.Var(extraFlag(params), "extra", "name=value of an additional field (repeatable)")
+	names := []string{"from", "to", "level", "host", "facility", "offset", "limit"}
+	values := make([]*string, len(names))
+	for i, name := range names {
+		usage := name
+		switch name {
+		case "from", "to":
+			usage += " time (RFC3339, or duration before now such as 1h)"
+		case "level":
+			usage = "least severe level (number or name)"
+		}
+		values[i] = fs.String(name, "", usage)
+	}
+	asJSON := fs.Bool("json", false, "print the messages as JSON")
+	full := fs.Bool("full", false, "print the full messages")
+	fs.Parse(args)
+	for i, name := range names {
+		if *values[i] != "" {
+			params.Set(name, *values[i])
+		}
+	}
+	if fs.NArg() > 0 {
+		params.Set("q", strings.Join(fs.Args(), " "))
+	}
+
+	c, err := loglib.NewAdminClient(*flagConfig)
+	if err != nil {
+		return err
+	}
+	res, err := c.Search(params)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, m := range res.Messages {
+		switch {
+		case *asJSON:
+			enc.Encode(m)
+		case *full:
+			fmt.Printf("%s\n\n", m.Long())
+		default:
+			fmt.Printf("%s %s\n", time.Unix(m.TimeUnix, 0).Format(time.RFC3339), m)
+		}
+	}
+	if !*asJSON {
+		fmt.Fprintf(os.Stderr, "%d of %d messages\n", len(res.Messages), res.Total)
+	}
+	return nil
+}
+
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	filter := fs.String("filter", "", "name of a filter of the filters config")
+	asJSON := fs.Bool("json", false, "print the messages as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s tail [flags] [expression...]
+
+Prints the processed messages matching the named filter and the
+expression (with the syntax of the expr filters) as they arrive.
+
+Flags:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	params := make(url.Values)
+	if *filter != "" {
+		params.Set("filter", *filter)
+	}
+	if fs.NArg() > 0 {
+		params.Set("expr", strings.Join(fs.Args(), " "))
+	}
+
+	c, err := loglib.NewAdminClient(*flagConfig)
 	if err != nil {
-		log.Fatalf("error loading config: %s", err)
+		return err
 	}
-	s.Serve()
+	enc := json.NewEncoder(os.Stdout)
+	return c.Tail(params,
+		func(m *loglib.Message) {
+			if *asJSON {
+				enc.Encode(m)
+				return
+			}
+			fmt.Printf("%s %s\n", time.Unix(m.TimeUnix, 0).Format(time.RFC3339), m)
+		},
+		func(n uint64) {
+			fmt.Fprintf(os.Stderr, "-- %d messages dropped --\n", n)
+		})
 }